@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/titan/ultraftp/internal/server"
+)
+
+var passwdCmd = &cobra.Command{
+	Use:   "passwd [username]",
+	Short: "Generate a users file entry",
+	Long: `Read a password from standard input and print a line for the
+server's users file.
+
+Example:
+  ultraftp passwd alice >> users.txt`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+		if strings.ContainsAny(username, ": \t") {
+			er("username must not contain ':' or whitespace")
+		}
+
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			er(err)
+		}
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			er("password must not be empty")
+		}
+
+		hash, err := server.HashPassword(password)
+		if err != nil {
+			er(err)
+		}
+		fmt.Printf("%s:%s\n", username, hash)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(passwdCmd)
+}
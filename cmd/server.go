@@ -1,15 +1,71 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/titan/ultraftp/internal/server"
+	"github.com/titan/ultraftp/pkg/common"
 )
 
 var (
-	serverPort int
-	serverDir  string
+	// serverConfig holds the settings shared with the environment, which
+	// provides the flag defaults
+	serverConfig = common.LoadConfig()
+
+	serverUsersFile    string
+	serverAnonymous    bool
+	serverAnonPerms    []string
+	serverDataTimeout  time.Duration
+	serverPassivePorts string
+	serverTLS          bool
+	serverTLSCert      string
+	serverTLSKey       string
+	serverRequireTLS   bool
+	serverShutdown     time.Duration
+	serverLogLevel     string
+	serverLogFormat    string
+	serverXferlog      string
+	serverMetricsAddr  string
+	serverMaxSessions  int
+	serverMaxPerIP     int
+	serverIdleTimeout  time.Duration
+	serverStallTimeout time.Duration
+	serverLoginDelay   time.Duration
+	serverMaxFailures  int
+	serverBanDuration  time.Duration
+	serverAllow        []string
+	serverDeny         []string
+	serverReadOnly     bool
+	serverBackend      string
+	serverMounts       []string
+	serverS3Endpoint   string
+	serverS3Region     string
+	serverS3PathStyle  bool
+	serverHookCommands []string
+	serverHookURLs     []string
+	serverHookEvents   string
+	serverHookRetries  int
+	serverHookTimeout  time.Duration
+	serverHookQueue    int
+
+	// Rate limits, parsed with common.ParseRate
+	serverDownloadRate        string
+	serverUploadRate          string
+	serverSessionDownloadRate string
+	serverSessionUploadRate   string
 )
 
 var serverCmd = &cobra.Command{
@@ -18,19 +74,330 @@ var serverCmd = &cobra.Command{
 	Long: `Start an FTP server that listens for client connections
 and handles file transfer operations.
 
+Users are read from a users file (see 'ultraftp passwd'). Anonymous
+access must be enabled explicitly with --anonymous.
+
 Example:
-  ultraftp server --port 2121 --dir /path/to/serve`,
+  ultraftp server --port 2121 --dir /path/to/serve --users users.txt
+  ultraftp server --port 2121 --dir /path/to/serve --anonymous`,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Printf("Starting FTP server on port %d serving directory %s\n", serverPort, serverDir)
-		if err := server.Start(serverPort, serverDir); err != nil {
+		if cmd.Flags().Changed("passive-ports") {
+			min, max, err := common.ParsePortRange(serverPassivePorts)
+			if err != nil {
+				er(err)
+			}
+			serverConfig.PassivePortMin = min
+			serverConfig.PassivePortMax = max
+		}
+		if err := serverConfig.ValidateServerConfig(); err != nil {
+			er(err)
+		}
+
+		logger, err := server.NewLogger(os.Stderr, serverLogLevel, serverLogFormat)
+		if err != nil {
+			er(err)
+		}
+
+		opts := server.Options{
+			Port:              serverConfig.ServerPort,
+			RootDir:           serverConfig.ServerDir,
+			AllowAnonymous:    serverAnonymous,
+			DataTimeout:       serverDataTimeout,
+			PassivePortMin:    serverConfig.PassivePortMin,
+			PassivePortMax:    serverConfig.PassivePortMax,
+			PublicHost:        serverConfig.PublicHost,
+			Logger:            logger,
+			MaxSessions:       serverMaxSessions,
+			MaxSessionsPerIP:  serverMaxPerIP,
+			IdleTimeout:       serverIdleTimeout,
+			StallTimeout:      serverStallTimeout,
+			LoginFailureDelay: serverLoginDelay,
+			MaxLoginFailures:  serverMaxFailures,
+			BanDuration:       serverBanDuration,
+			ReadOnly:          serverReadOnly,
+		}
+
+		for _, s := range serverAnonPerms {
+			rule, err := server.ParsePermissionRule(s)
+			if err != nil {
+				er(fmt.Errorf("--anonymous-perms: %w", err))
+			}
+			opts.AnonymousPermissions = append(opts.AnonymousPermissions, rule)
+		}
+
+		if serverTLS || serverRequireTLS || serverTLSCert != "" {
+			tlsConfig, err := loadServerTLSConfig(logger)
+			if err != nil {
+				er(err)
+			}
+			opts.TLSConfig = tlsConfig
+			opts.RequireTLS = serverRequireTLS
+		}
+
+		fsys, err := serverFileSystem()
+		if err != nil {
+			er(err)
+		}
+		opts.FileSystem = fsys
+
+		for _, spec := range serverMounts {
+			mount, err := server.ParseMount(spec)
+			if err != nil {
+				er(err)
+			}
+			opts.Mounts = append(opts.Mounts, mount)
+		}
+
+		// With mounts, the directory is only served at / if asked for
+		if len(opts.Mounts) > 0 && !cmd.Flags().Changed("dir") && os.Getenv("ULTRAFTP_SERVER_DIR") == "" {
+			opts.RootDir = ""
+		}
+
+		if err := parseServerRates(&opts); err != nil {
+			er(err)
+		}
+
+		if err := parseServerHooks(&opts); err != nil {
 			er(err)
 		}
+
+		ipFilter, err := server.ParseIPFilter(serverAllow, serverDeny)
+		if err != nil {
+			er(err)
+		}
+		opts.IPFilter = ipFilter
+
+		if serverXferlog != "" {
+			xferlog, err := os.OpenFile(serverXferlog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+			if err != nil {
+				er(fmt.Errorf("cannot open transfer log: %w", err))
+			}
+			defer xferlog.Close()
+			opts.TransferLog = xferlog
+		}
+
+		if serverUsersFile != "" {
+			auth, err := server.NewFileAuthenticator(serverUsersFile)
+			if err != nil {
+				er(err)
+			}
+			opts.Authenticator = auth
+		} else if !serverAnonymous {
+			er("no users file given; use --users to authenticate users or --anonymous to allow anonymous access")
+		}
+
+		srv, err := server.New(opts)
+		if err != nil {
+			er(err)
+		}
+
+		if serverMetricsAddr != "" {
+			metricsServer, err := startMetricsServer(serverMetricsAddr, srv, logger)
+			if err != nil {
+				er(err)
+			}
+			defer metricsServer.Close()
+		}
+
+		// Shut down gracefully on SIGINT or SIGTERM
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		shutdownDone := make(chan error, 1)
+		go func() {
+			<-ctx.Done()
+			stop()
+			logger.Info("Shutting down, waiting for transfers to finish", "timeout", serverShutdown)
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdown)
+			defer cancel()
+			shutdownDone <- srv.Shutdown(shutdownCtx)
+		}()
+
+		if err := srv.ListenAndServe(); !errors.Is(err, server.ErrServerClosed) {
+			er(err)
+		}
+		if err := <-shutdownDone; err != nil {
+			logger.Warn("Shutdown timed out; remaining sessions were closed")
+		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(serverCmd)
 
-	serverCmd.Flags().IntVarP(&serverPort, "port", "p", 2121, "Port to listen on")
-	serverCmd.Flags().StringVarP(&serverDir, "dir", "d", ".", "Directory to serve")
+	serverCmd.Flags().IntVarP(&serverConfig.ServerPort, "port", "p", serverConfig.ServerPort, "Port to listen on")
+	serverCmd.Flags().StringVarP(&serverConfig.ServerDir, "dir", "d", serverConfig.ServerDir, "Directory to serve")
+	serverCmd.Flags().StringVar(&serverBackend, "backend", "dir", "Storage backend: dir to serve --dir, memory for an ephemeral in-memory file system, or s3://bucket/prefix")
+	serverCmd.Flags().StringVar(&serverS3Endpoint, "s3-endpoint", os.Getenv("AWS_ENDPOINT_URL_S3"), "S3 API endpoint for S3-compatible servers, e.g. http://localhost:9000 (default AWS)")
+	serverCmd.Flags().StringVar(&serverS3Region, "s3-region", awsRegion(), "S3 region")
+	serverCmd.Flags().BoolVar(&serverS3PathStyle, "s3-path-style", false, "Address the S3 bucket in the URL path, as most S3-compatible servers require")
+	serverCmd.Flags().StringArrayVar(&serverMounts, "mount", nil, "Serve a local directory at a virtual path, as /path=directory[:ro] (repeatable)")
+	serverCmd.Flags().StringVarP(&serverUsersFile, "users", "u", "", "Users file with username:bcrypt-hash lines")
+	serverCmd.Flags().BoolVar(&serverAnonymous, "anonymous", false, "Allow anonymous logins")
+	serverCmd.Flags().StringArrayVar(&serverAnonPerms, "anonymous-perms", nil, "What anonymous users may do, as [/path:]permissions like the perms attribute of users files (repeatable, default read)")
+	serverCmd.Flags().DurationVar(&serverDataTimeout, "data-timeout", server.DefaultDataTimeout, "How long to wait for a data connection")
+	serverCmd.Flags().StringVar(&serverPassivePorts, "passive-ports", "", "Port range for passive data connections, e.g. 50000-50100")
+	serverCmd.Flags().StringVar(&serverConfig.PublicHost, "public-host", serverConfig.PublicHost, "IP address or hostname to advertise in passive mode replies")
+	serverCmd.Flags().BoolVar(&serverReadOnly, "read-only", false, "Refuse every command that would modify files")
+	serverCmd.Flags().BoolVar(&serverTLS, "tls", false, "Enable explicit FTPS (AUTH TLS)")
+	serverCmd.Flags().StringVar(&serverTLSCert, "tls-cert", "", "TLS certificate file (PEM); a self-signed certificate is generated if omitted")
+	serverCmd.Flags().StringVar(&serverTLSKey, "tls-key", "", "TLS private key file (PEM)")
+	serverCmd.Flags().BoolVar(&serverRequireTLS, "require-tls", false, "Require AUTH TLS before USER is accepted")
+	serverCmd.Flags().DurationVar(&serverShutdown, "shutdown-timeout", 30*time.Second, "How long to let transfers finish when shutting down")
+	serverCmd.Flags().StringVar(&serverLogLevel, "log-level", "info", "Log level: debug, info, warn or error")
+	serverCmd.Flags().StringVar(&serverLogFormat, "log-format", "text", "Log format: text or json")
+	serverCmd.Flags().StringVar(&serverXferlog, "xferlog", "", "Append a line in xferlog format for every file transfer to this file")
+	serverCmd.Flags().IntVar(&serverMaxSessions, "max-sessions", 0, "Maximum number of concurrent sessions (0 for unlimited)")
+	serverCmd.Flags().IntVar(&serverMaxPerIP, "max-sessions-per-ip", 0, "Maximum number of concurrent sessions from one address (0 for unlimited)")
+	serverCmd.Flags().DurationVar(&serverIdleTimeout, "idle-timeout", 5*time.Minute, "Close control connections idle for this long (0 to disable)")
+	serverCmd.Flags().DurationVar(&serverStallTimeout, "stall-timeout", 5*time.Minute, "Abort transfers when no data moves for this long (0 to disable)")
+	serverCmd.Flags().DurationVar(&serverLoginDelay, "login-delay", time.Second, "Delay before rejecting a failed login, doubling with each further failure (0 to disable)")
+	serverCmd.Flags().IntVar(&serverMaxFailures, "max-login-failures", 5, "Ban an address after this many failed logins in a row (0 to disable)")
+	serverCmd.Flags().DurationVar(&serverBanDuration, "ban-duration", 15*time.Minute, "How long an address stays banned")
+	serverCmd.Flags().StringSliceVar(&serverAllow, "allow", nil, "Only accept clients from these networks, e.g. 10.0.0.0/8,2001:db8::/32 (repeatable)")
+	serverCmd.Flags().StringSliceVar(&serverDeny, "deny", nil, "Refuse clients from these networks (repeatable)")
+	serverCmd.Flags().StringVar(&serverDownloadRate, "download-rate", "0", "Maximum combined download rate of all sessions, e.g. 10M (0 for unlimited)")
+	serverCmd.Flags().StringVar(&serverUploadRate, "upload-rate", "0", "Maximum combined upload rate of all sessions")
+	serverCmd.Flags().StringVar(&serverSessionDownloadRate, "session-download-rate", "0", "Maximum download rate of each session")
+	serverCmd.Flags().StringVar(&serverSessionUploadRate, "session-upload-rate", "0", "Maximum upload rate of each session")
+	serverCmd.Flags().StringArrayVar(&serverHookCommands, "hook-command", nil, "Run this shell command for every event, with the event in ULTRAFTP_* variables and as JSON on stdin (repeatable)")
+	serverCmd.Flags().StringArrayVar(&serverHookURLs, "hook-url", nil, "POST every event as JSON to this URL (repeatable)")
+	serverCmd.Flags().StringVar(&serverHookEvents, "hook-events", "", "Only send these events to hooks, e.g. upload,delete (default all)")
+	serverCmd.Flags().IntVar(&serverHookRetries, "hook-retries", 3, "How often to retry a failed hook")
+	serverCmd.Flags().DurationVar(&serverHookTimeout, "hook-timeout", server.DefaultEventTimeout, "How long each hook attempt may take")
+	serverCmd.Flags().IntVar(&serverHookQueue, "hook-queue-size", server.DefaultEventQueueSize, "How many events may wait for each hook before new ones are dropped")
+	serverCmd.Flags().StringVar(&serverMetricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics and /healthz on, e.g. :9100")
+}
+
+// loadServerTLSConfig loads the certificate given on the command line, or
+// generates a self-signed one if none was given
+func loadServerTLSConfig(logger *slog.Logger) (*tls.Config, error) {
+	if serverTLSCert != "" || serverTLSKey != "" {
+		if serverTLSCert == "" || serverTLSKey == "" {
+			return nil, fmt.Errorf("--tls-cert and --tls-key must be given together")
+		}
+		return server.LoadTLSConfig(serverTLSCert, serverTLSKey)
+	}
+
+	hosts := server.DefaultSelfSignedHosts()
+	if serverConfig.PublicHost != "" {
+		hosts = append(hosts, serverConfig.PublicHost)
+	}
+	tlsConfig, err := server.SelfSignedTLSConfig(hosts)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Using a self-signed TLS certificate", "sha256", server.CertificateFingerprint(tlsConfig))
+	return tlsConfig, nil
+}
+
+// serverFileSystem returns the file system selected with --backend, or nil
+// to serve --dir
+func serverFileSystem() (server.FileSystem, error) {
+	switch {
+	case serverBackend == "dir":
+		return nil, nil
+	case serverBackend == "memory":
+		return server.NewMemFileSystem(), nil
+	case strings.HasPrefix(serverBackend, "s3://"):
+		bucket, prefix, err := server.ParseS3URL(serverBackend)
+		if err != nil {
+			return nil, err
+		}
+		// Credentials come from the usual AWS environment variables
+		return server.NewS3FileSystem(server.S3Config{
+			Bucket:          bucket,
+			Prefix:          prefix,
+			Endpoint:        serverS3Endpoint,
+			Region:          serverS3Region,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			PathStyle:       serverS3PathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("unknown backend %q, expected dir, memory or s3://bucket/prefix", serverBackend)
+	}
+}
+
+// awsRegion returns the region set in the AWS environment variables
+func awsRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	if region := os.Getenv("AWS_DEFAULT_REGION"); region != "" {
+		return region
+	}
+	return "us-east-1"
+}
+
+// parseServerRates parses the rate limit flags into the server options
+func parseServerRates(opts *server.Options) error {
+	rates := []struct {
+		flag   string
+		value  string
+		target *int64
+	}{
+		{"--download-rate", serverDownloadRate, &opts.GlobalRateLimits.Download},
+		{"--upload-rate", serverUploadRate, &opts.GlobalRateLimits.Upload},
+		{"--session-download-rate", serverSessionDownloadRate, &opts.SessionRateLimits.Download},
+		{"--session-upload-rate", serverSessionUploadRate, &opts.SessionRateLimits.Upload},
+	}
+	for _, rate := range rates {
+		bytesPerSecond, err := common.ParseRate(rate.value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rate.flag, err)
+		}
+		*rate.target = bytesPerSecond
+	}
+	return nil
+}
+
+// parseServerHooks sets up the event hooks given on the command line
+func parseServerHooks(opts *server.Options) error {
+	for _, command := range serverHookCommands {
+		opts.EventSinks = append(opts.EventSinks, &server.CommandSink{Command: command})
+	}
+	for _, hookURL := range serverHookURLs {
+		u, err := url.Parse(hookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("--hook-url: invalid URL %q", hookURL)
+		}
+		opts.EventSinks = append(opts.EventSinks, &server.WebhookSink{URL: hookURL})
+	}
+
+	if serverHookEvents != "" {
+		types, err := server.ParseEventTypes(serverHookEvents)
+		if err != nil {
+			return fmt.Errorf("--hook-events: %w", err)
+		}
+		opts.EventTypes = types
+	}
+
+	opts.EventRetries = serverHookRetries
+	opts.EventTimeout = serverHookTimeout
+	opts.EventQueueSize = serverHookQueue
+	return nil
+}
+
+// startMetricsServer serves the FTP server's metrics and health check over
+// HTTP on addr
+func startMetricsServer(addr string, srv *server.FTPServer, logger *slog.Logger) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for metrics: %w", err)
+	}
+
+	metricsServer := &http.Server{
+		Handler:           srv.MetricsHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := metricsServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Metrics server failed", "error", err)
+		}
+	}()
+
+	logger.Info("Serving metrics", "addr", listener.Addr().String())
+	return metricsServer, nil
 }
@@ -2,8 +2,12 @@ module github.com/titan/ultraftp
 
 go 1.21.0
 
+require (
+	github.com/spf13/cobra v1.9.1
+	golang.org/x/crypto v0.31.0
+)
+
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/spf13/cobra v1.9.1 // indirect
 	github.com/spf13/pflag v1.0.6 // indirect
 )
@@ -2,14 +2,16 @@ package client
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/url"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+
+	"github.com/titan/ultraftp/pkg/common"
 )
 
 // FTPClient represents an FTP client
@@ -22,13 +24,58 @@ type FTPClient struct {
 	port          int
 	user          string
 	password      string
+	noEPSV        bool
+	tlsConfig     *tls.Config
+	protPrivate   bool
+	limiter       *common.RateLimiter
+}
+
+// Options configures how the client connects to a server
+type Options struct {
+	// TLS selects plain FTP, explicit FTPS or implicit FTPS. URLs with an
+	// ftps:// or ftpes:// scheme override it.
+	TLS TLSMode
+	// CAFile is a PEM file with CA certificates to trust instead of the
+	// system pool
+	CAFile string
+	// Pins are SHA-256 fingerprints of server certificates to accept. When
+	// set, only these certificates are trusted.
+	Pins []string
+	// Insecure skips server certificate verification
+	Insecure bool
+	// Continue resumes partial transfers instead of starting over
+	Continue bool
+	// LimitRate caps transfer speed in bytes per second. Zero means
+	// unlimited.
+	LimitRate int64
 }
 
-// Connect establishes a connection to an FTP server
+// Connect establishes a plain connection to an FTP server
 func Connect(host string, port int) (*FTPClient, error) {
+	return ConnectWithOptions(host, port, Options{})
+}
+
+// ConnectWithOptions establishes a connection to an FTP server, securing it
+// with TLS if the options ask for it
+func ConnectWithOptions(host string, port int, opts Options) (*FTPClient, error) {
+	var tlsConfig *tls.Config
+	if opts.TLS != TLSNone {
+		var err error
+		tlsConfig, err = buildTLSConfig(host, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Connect to the server
-	addr := fmt.Sprintf("%s:%d", host, port)
-	conn, err := net.Dial("tcp", addr)
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	var conn net.Conn
+	var err error
+	if opts.TLS == TLSImplicit {
+		conn, err = tls.Dial("tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
 	}
@@ -41,6 +88,8 @@ func Connect(host string, port int) (*FTPClient, error) {
 		port:          port,
 		user:          "anonymous", // Default to anonymous login
 		password:      "guest@",
+		tlsConfig:     tlsConfig,
+		limiter:       common.NewRateLimiter(opts.LimitRate),
 	}
 
 	// Read the welcome message
@@ -50,6 +99,22 @@ func Connect(host string, port int) (*FTPClient, error) {
 		return nil, fmt.Errorf("error reading welcome message: %w", err)
 	}
 
+	// Secure the control connection if it isn't already
+	if opts.TLS == TLSExplicit {
+		if err := client.startTLS(); err != nil {
+			client.conn.Close()
+			return nil, err
+		}
+	}
+
+	// Protect data connections too
+	if opts.TLS != TLSNone {
+		if err := client.protectData(); err != nil {
+			client.conn.Close()
+			return nil, err
+		}
+	}
+
 	return client, nil
 }
 
@@ -102,26 +167,20 @@ func (c *FTPClient) Close() error {
 }
 
 // Get downloads a file from the FTP server
-func Get(url string, localPath string) error {
+func Get(url string, localPath string, opts Options) error {
 	// Parse the URL
 	ftpURL, err := parseURL(url)
 	if err != nil {
 		return err
 	}
 
-	// Connect to the server
-	client, err := Connect(ftpURL.host, ftpURL.port)
+	// Connect to the server and log in
+	client, err := ftpURL.connect(opts)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	// Login
-	err = client.Login(ftpURL.user, ftpURL.password)
-	if err != nil {
-		return err
-	}
-
 	// Change to the directory if needed
 	if ftpURL.path != "" && filepath.Dir(ftpURL.path) != "." && filepath.Dir(ftpURL.path) != "/" {
 		dirPath := filepath.Dir(ftpURL.path)
@@ -131,80 +190,27 @@ func Get(url string, localPath string) error {
 		}
 	}
 
-	// Set binary mode
-	_, _, err = client.sendCommand("TYPE I")
-	if err != nil {
-		return fmt.Errorf("failed to set binary mode: %w", err)
-	}
-
-	// Enter passive mode
-	err = client.enterPassiveMode()
-	if err != nil {
-		return fmt.Errorf("failed to enter passive mode: %w", err)
-	}
-
-	// Send RETR command
+	// Download the file
 	filename := filepath.Base(ftpURL.path)
-	code, msg, err := client.sendCommand(fmt.Sprintf("RETR %s", filename))
-	if err != nil {
-		return err
-	}
-
-	if code != 150 && code != 125 {
-		return fmt.Errorf("failed to retrieve file: %d %s", code, msg)
-	}
-
-	// Create the local file
-	file, err := os.Create(localPath)
-	if err != nil {
-		return fmt.Errorf("failed to create local file: %w", err)
-	}
-	defer file.Close()
-
-	// Copy the data
-	_, err = io.Copy(file, client.dataConn)
-	if err != nil {
-		return fmt.Errorf("error downloading file: %w", err)
-	}
-
-	// Close the data connection
-	client.dataConn.Close()
-	client.dataConn = nil
-
-	// Read the transfer complete message
-	code, msg, err = client.readResponse()
-	if err != nil {
-		return err
-	}
-
-	if code != 226 && code != 250 {
-		return fmt.Errorf("unexpected response after transfer: %d %s", code, msg)
-	}
-
-	return nil
+	_, err = client.download(filename, localPath, opts.Continue)
+	return err
 }
 
 // Put uploads a file to the FTP server
-func Put(localPath string, url string) error {
+func Put(localPath string, url string, opts Options) error {
 	// Parse the URL
 	ftpURL, err := parseURL(url)
 	if err != nil {
 		return err
 	}
 
-	// Connect to the server
-	client, err := Connect(ftpURL.host, ftpURL.port)
+	// Connect to the server and log in
+	client, err := ftpURL.connect(opts)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	// Login
-	err = client.Login(ftpURL.user, ftpURL.password)
-	if err != nil {
-		return err
-	}
-
 	// Change to the directory if needed
 	if ftpURL.path != "" && filepath.Dir(ftpURL.path) != "." && filepath.Dir(ftpURL.path) != "/" {
 		dirPath := filepath.Dir(ftpURL.path)
@@ -214,57 +220,10 @@ func Put(localPath string, url string) error {
 		}
 	}
 
-	// Set binary mode
-	_, _, err = client.sendCommand("TYPE I")
-	if err != nil {
-		return fmt.Errorf("failed to set binary mode: %w", err)
-	}
-
-	// Enter passive mode
-	err = client.enterPassiveMode()
-	if err != nil {
-		return fmt.Errorf("failed to enter passive mode: %w", err)
-	}
-
-	// Open the local file
-	file, err := os.Open(localPath)
-	if err != nil {
-		return fmt.Errorf("failed to open local file: %w", err)
-	}
-	defer file.Close()
-
-	// Send STOR command
+	// Upload the file
 	filename := filepath.Base(ftpURL.path)
-	code, msg, err := client.sendCommand(fmt.Sprintf("STOR %s", filename))
-	if err != nil {
-		return err
-	}
-
-	if code != 150 && code != 125 {
-		return fmt.Errorf("failed to store file: %d %s", code, msg)
-	}
-
-	// Copy the data
-	_, err = io.Copy(client.dataConn, file)
-	if err != nil {
-		return fmt.Errorf("error uploading file: %w", err)
-	}
-
-	// Close the data connection
-	client.dataConn.Close()
-	client.dataConn = nil
-
-	// Read the transfer complete message
-	code, msg, err = client.readResponse()
-	if err != nil {
-		return err
-	}
-
-	if code != 226 && code != 250 {
-		return fmt.Errorf("unexpected response after transfer: %d %s", code, msg)
-	}
-
-	return nil
+	_, err = client.upload(localPath, filename, opts.Continue)
+	return err
 }
 
 // sendCommand sends a command to the FTP server and reads the response
@@ -326,7 +285,9 @@ func (c *FTPClient) readResponse() (int, string, error) {
 	return code, message, nil
 }
 
-// enterPassiveMode switches to passive mode and establishes a data connection
+// enterPassiveMode switches to passive mode and establishes a data connection.
+// It prefers EPSV (RFC 2428), which works over IPv6 and through NAT, and
+// falls back to PASV for servers that don't support it.
 func (c *FTPClient) enterPassiveMode() error {
 	// Close any existing data connection
 	if c.dataConn != nil {
@@ -334,14 +295,87 @@ func (c *FTPClient) enterPassiveMode() error {
 		c.dataConn = nil
 	}
 
-	// Send PASV command
+	var addr string
+	var err error
+	if !c.noEPSV {
+		addr, err = c.extendedPassive()
+		if err == errEPSVUnsupported {
+			// Don't bother trying EPSV again on this connection
+			c.noEPSV = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if c.noEPSV {
+		addr, err = c.passive()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Connect to the data port
+	dataConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to data port: %w", err)
+	}
+
+	c.dataConn = c.wrapData(dataConn)
+	return nil
+}
+
+// errEPSVUnsupported is returned when the server rejects the EPSV command
+var errEPSVUnsupported = errors.New("EPSV not supported")
+
+// extendedPassive sends EPSV and returns the address to connect to
+func (c *FTPClient) extendedPassive() (string, error) {
+	code, msg, err := c.sendCommand("EPSV")
+	if err != nil {
+		return "", err
+	}
+
+	if code >= 500 && code < 600 {
+		return "", errEPSVUnsupported
+	}
+	if code != 229 {
+		return "", fmt.Errorf("extended passive mode failed: %d %s", code, msg)
+	}
+
+	// Parse the response to get the data connection port
+	// The response format is: 229 Entering Extended Passive Mode (|||port|)
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start == -1 || end == -1 || end-start < 5 {
+		return "", fmt.Errorf("invalid EPSV response format: %s", msg)
+	}
+
+	inner := msg[start+1 : end]
+	fields := strings.Split(inner[1:], inner[:1])
+	if len(fields) != 4 {
+		return "", fmt.Errorf("invalid EPSV response format: %s", msg)
+	}
+	port, err := strconv.Atoi(fields[2])
+	if err != nil || port <= 0 || port > 65535 {
+		return "", fmt.Errorf("invalid EPSV response format: %s", msg)
+	}
+
+	// The data connection goes to the same host as the control connection
+	host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// passive sends PASV and returns the address to connect to
+func (c *FTPClient) passive() (string, error) {
 	code, msg, err := c.sendCommand("PASV")
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if code != 227 {
-		return fmt.Errorf("passive mode failed: %d %s", code, msg)
+		return "", fmt.Errorf("passive mode failed: %d %s", code, msg)
 	}
 
 	// Parse the response to get the data connection address
@@ -349,13 +383,13 @@ func (c *FTPClient) enterPassiveMode() error {
 	start := strings.Index(msg, "(")
 	end := strings.Index(msg, ")")
 	if start == -1 || end == -1 {
-		return fmt.Errorf("invalid PASV response format: %s", msg)
+		return "", fmt.Errorf("invalid PASV response format: %s", msg)
 	}
 
 	// Extract the IP and port
 	parts := strings.Split(msg[start+1:end], ",")
 	if len(parts) != 6 {
-		return fmt.Errorf("invalid PASV response format: %s", msg)
+		return "", fmt.Errorf("invalid PASV response format: %s", msg)
 	}
 
 	// Convert the parts to integers
@@ -363,7 +397,7 @@ func (c *FTPClient) enterPassiveMode() error {
 	for i, p := range parts {
 		num, err := strconv.Atoi(strings.TrimSpace(p))
 		if err != nil {
-			return fmt.Errorf("invalid PASV response format: %s", msg)
+			return "", fmt.Errorf("invalid PASV response format: %s", msg)
 		}
 		nums[i] = num
 	}
@@ -372,15 +406,7 @@ func (c *FTPClient) enterPassiveMode() error {
 	ip := fmt.Sprintf("%d.%d.%d.%d", nums[0], nums[1], nums[2], nums[3])
 	port := nums[4]*256 + nums[5]
 
-	// Connect to the data port
-	addr := fmt.Sprintf("%s:%d", ip, port)
-	dataConn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to connect to data port: %w", err)
-	}
-
-	c.dataConn = dataConn
-	return nil
+	return net.JoinHostPort(ip, strconv.Itoa(port)), nil
 }
 
 // FTPURL represents a parsed FTP URL
@@ -390,9 +416,11 @@ type FTPURL struct {
 	user     string
 	password string
 	path     string
+	tls      TLSMode
 }
 
-// parseURL parses an FTP URL
+// parseURL parses an FTP URL. Besides ftp://, it accepts ftps:// for
+// implicit FTPS and ftpes:// for explicit FTPS.
 func parseURL(rawURL string) (FTPURL, error) {
 	result := FTPURL{
 		port:     21,
@@ -407,7 +435,15 @@ func parseURL(rawURL string) (FTPURL, error) {
 	}
 
 	// Check the scheme
-	if u.Scheme != "ftp" {
+	switch u.Scheme {
+	case "ftp":
+		result.tls = TLSNone
+	case "ftpes":
+		result.tls = TLSExplicit
+	case "ftps":
+		result.tls = TLSImplicit
+		result.port = 990
+	default:
 		return result, fmt.Errorf("unsupported scheme: %s", u.Scheme)
 	}
 
@@ -437,3 +473,23 @@ func parseURL(rawURL string) (FTPURL, error) {
 
 	return result, nil
 }
+
+// connect connects and logs in to the server named by the URL. The URL's
+// scheme takes precedence over the TLS mode in opts.
+func (u FTPURL) connect(opts Options) (*FTPClient, error) {
+	if u.tls != TLSNone {
+		opts.TLS = u.tls
+	}
+
+	client, err := ConnectWithOptions(u.host, u.port, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.Login(u.user, u.password); err != nil {
+		client.conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
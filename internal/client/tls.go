@@ -0,0 +1,148 @@
+package client
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// TLSMode selects whether and how the client uses TLS
+type TLSMode int
+
+const (
+	// TLSNone uses plain FTP
+	TLSNone TLSMode = iota
+	// TLSExplicit connects in the clear and upgrades with AUTH TLS (ftpes://)
+	TLSExplicit
+	// TLSImplicit starts TLS as soon as the connection is made (ftps://)
+	TLSImplicit
+)
+
+// buildTLSConfig returns the TLS configuration for connecting to host
+func buildTLSConfig(host string, opts Options) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         host,
+		MinVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+
+	// Trust a specific CA instead of the system pool if asked to
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", opts.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if len(opts.Pins) > 0 {
+		pins := make(map[string]bool, len(opts.Pins))
+		for _, pin := range opts.Pins {
+			normalized, err := normalizePin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pins[normalized] = true
+		}
+
+		// A pinned certificate is trusted on its own, so the usual chain
+		// verification is replaced by the fingerprint check
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+			fingerprint := hex.EncodeToString(sum[:])
+			if !pins[fingerprint] {
+				return fmt.Errorf("server certificate %s does not match any pinned fingerprint", fingerprint)
+			}
+			return nil
+		}
+	} else if opts.Insecure {
+		config.InsecureSkipVerify = true
+	}
+
+	return config, nil
+}
+
+// normalizePin converts a SHA-256 fingerprint given as hex, optionally with
+// colons and a "sha256:" prefix, to lower case hex without separators
+func normalizePin(pin string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(pin))
+	normalized = strings.TrimPrefix(normalized, "sha256:")
+	normalized = strings.ReplaceAll(normalized, ":", "")
+
+	decoded, err := hex.DecodeString(normalized)
+	if err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("invalid certificate pin %q, expected a SHA-256 fingerprint", pin)
+	}
+	return normalized, nil
+}
+
+// startTLS upgrades the control connection with AUTH TLS
+func (c *FTPClient) startTLS() error {
+	code, msg, err := c.sendCommand("AUTH TLS")
+	if err != nil {
+		return err
+	}
+
+	if code != 234 {
+		return fmt.Errorf("server refused AUTH TLS: %d %s", code, msg)
+	}
+
+	tlsConn := tls.Client(c.conn, c.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+
+	c.conn = tlsConn
+	c.controlReader = bufio.NewReader(tlsConn)
+	c.controlWriter = bufio.NewWriter(tlsConn)
+	return nil
+}
+
+// protectData asks the server to encrypt data connections with PBSZ and PROT
+func (c *FTPClient) protectData() error {
+	code, msg, err := c.sendCommand("PBSZ 0")
+	if err != nil {
+		return err
+	}
+
+	if code != 200 {
+		return fmt.Errorf("PBSZ failed: %d %s", code, msg)
+	}
+
+	code, msg, err = c.sendCommand("PROT P")
+	if err != nil {
+		return err
+	}
+
+	if code != 200 {
+		return fmt.Errorf("PROT P failed: %d %s", code, msg)
+	}
+
+	c.protPrivate = true
+	return nil
+}
+
+// wrapData wraps a data connection in TLS if data protection is on. The
+// handshake happens on first use, after the transfer command has been sent,
+// which is when the server expects it.
+func (c *FTPClient) wrapData(conn net.Conn) net.Conn {
+	if !c.protPrivate {
+		return conn
+	}
+	return tls.Client(conn, c.tlsConfig)
+}
@@ -0,0 +1,206 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/titan/ultraftp/pkg/common"
+)
+
+// download retrieves a remote file into localPath and returns the number of
+// bytes transferred. If resume is set and localPath already holds the start
+// of the file, only the rest is transferred.
+func (c *FTPClient) download(remotePath, localPath string, resume bool) (int64, error) {
+	// Set binary mode
+	_, _, err := c.sendCommand("TYPE I")
+	if err != nil {
+		return 0, fmt.Errorf("failed to set binary mode: %w", err)
+	}
+
+	// Work out how much of the file we already have
+	var offset int64
+	if resume {
+		localSize := localFileSize(localPath)
+		remoteSize, err := c.size(remotePath)
+		switch {
+		case err != nil || localSize > remoteSize:
+			// Can't tell, or the local file isn't a prefix; start over
+		case localSize == remoteSize:
+			fmt.Printf("%s is already complete\n", localPath)
+			return 0, nil
+		default:
+			offset = localSize
+		}
+	}
+
+	// Enter passive mode
+	err = c.enterPassiveMode()
+	if err != nil {
+		return 0, fmt.Errorf("failed to enter passive mode: %w", err)
+	}
+
+	// REST has to come immediately before RETR
+	if offset > 0 && !c.restart(offset) {
+		offset = 0
+	}
+
+	// Send RETR command
+	code, msg, err := c.sendCommand(fmt.Sprintf("RETR %s", remotePath))
+	if err != nil {
+		return 0, err
+	}
+
+	if code != 150 && code != 125 {
+		return 0, fmt.Errorf("failed to retrieve file: %d %s", code, msg)
+	}
+
+	// Open the local file, keeping what we already have when resuming
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(localPath, flags, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create local file: %w", err)
+	}
+	defer file.Close()
+
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("failed to seek local file: %w", err)
+		}
+		fmt.Printf("Resuming download at byte %d\n", offset)
+	}
+
+	// Copy the data
+	n, err := io.Copy(file, common.NewLimitedReader(c.dataConn, c.limiter))
+	if err != nil {
+		return n, fmt.Errorf("error downloading file: %w", err)
+	}
+
+	return n, c.finishTransfer()
+}
+
+// upload stores localPath as a remote file and returns the number of bytes
+// transferred. If resume is set and the remote file holds the start of the
+// local file, only the rest is appended.
+func (c *FTPClient) upload(localPath, remotePath string, resume bool) (int64, error) {
+	// Open the local file
+	file, err := os.Open(localPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer file.Close()
+
+	// Set binary mode
+	_, _, err = c.sendCommand("TYPE I")
+	if err != nil {
+		return 0, fmt.Errorf("failed to set binary mode: %w", err)
+	}
+
+	// Work out how much of the file the server already has
+	var offset int64
+	if resume {
+		localSize := localFileSize(localPath)
+		remoteSize, err := c.size(remotePath)
+		switch {
+		case err != nil || remoteSize > localSize:
+			// Nothing there, or the remote file isn't a prefix; start over
+		case remoteSize == localSize:
+			fmt.Printf("%s is already complete\n", remotePath)
+			return 0, nil
+		default:
+			offset = remoteSize
+		}
+	}
+
+	// Enter passive mode
+	err = c.enterPassiveMode()
+	if err != nil {
+		return 0, fmt.Errorf("failed to enter passive mode: %w", err)
+	}
+
+	// Append to the partial remote file, or replace it completely
+	command := "STOR"
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("failed to seek local file: %w", err)
+		}
+		command = "APPE"
+		fmt.Printf("Resuming upload at byte %d\n", offset)
+	}
+
+	code, msg, err := c.sendCommand(fmt.Sprintf("%s %s", command, remotePath))
+	if err != nil {
+		return 0, err
+	}
+
+	if code != 150 && code != 125 {
+		return 0, fmt.Errorf("failed to store file: %d %s", code, msg)
+	}
+
+	// Copy the data
+	n, err := io.Copy(common.NewLimitedWriter(c.dataConn, c.limiter), file)
+	if err != nil {
+		return n, fmt.Errorf("error uploading file: %w", err)
+	}
+
+	return n, c.finishTransfer()
+}
+
+// finishTransfer closes the data connection and reads the transfer complete
+// message
+func (c *FTPClient) finishTransfer() error {
+	// Close the data connection
+	c.dataConn.Close()
+	c.dataConn = nil
+
+	// Read the transfer complete message
+	code, msg, err := c.readResponse()
+	if err != nil {
+		return err
+	}
+
+	if code != 226 && code != 250 {
+		return fmt.Errorf("unexpected response after transfer: %d %s", code, msg)
+	}
+
+	return nil
+}
+
+// size returns the size of a remote file using the SIZE command
+func (c *FTPClient) size(remotePath string) (int64, error) {
+	code, msg, err := c.sendCommand(fmt.Sprintf("SIZE %s", remotePath))
+	if err != nil {
+		return 0, err
+	}
+
+	if code != 213 {
+		return 0, fmt.Errorf("SIZE failed: %d %s", code, msg)
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid SIZE response: %s", msg)
+	}
+
+	return size, nil
+}
+
+// restart sends REST and reports whether the server accepted the offset
+func (c *FTPClient) restart(offset int64) bool {
+	code, _, err := c.sendCommand(fmt.Sprintf("REST %d", offset))
+	return err == nil && code == 350
+}
+
+// localFileSize returns the size of a local file, or 0 if it doesn't exist
+func localFileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/titan/ultraftp/pkg/common"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidCredentials is returned when a username or password is rejected
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// User represents an authenticated FTP user
+type User struct {
+	Name      string
+	Anonymous bool
+	// RateLimits throttles the user's transfers, shared across all of the
+	// user's sessions
+	RateLimits RateLimits
+	// IPFilter restricts the addresses the user may log in from
+	IPFilter IPFilter
+	// Permissions are what the user may do in each directory subtree. A
+	// user without rules may do everything.
+	Permissions []PermissionRule
+	// HomeDir is the directory the user is confined to, which the user
+	// sees as "/". A relative path is taken relative to the server root.
+	// If empty, the user sees the whole server root.
+	HomeDir string
+}
+
+// Authenticator verifies the credentials supplied with USER and PASS
+type Authenticator interface {
+	// Authenticate returns the user for the given credentials, or
+	// ErrInvalidCredentials if they are not accepted
+	Authenticate(username, password string) (*User, error)
+}
+
+// HomeDirLister is implemented by authenticators that know the home
+// directories of all their users up front. The server removes abandoned
+// uploads from those on the local disk when it starts.
+type HomeDirLister interface {
+	// HomeDirs returns the home directories users are confined to
+	HomeDirs() []string
+}
+
+// anonymousNames are the usernames treated as anonymous logins
+var anonymousNames = map[string]bool{
+	"anonymous": true,
+	"ftp":       true,
+}
+
+// isAnonymousName reports whether a username requests an anonymous login
+func isAnonymousName(username string) bool {
+	return anonymousNames[strings.ToLower(username)]
+}
+
+// defaultAnonymousPermissions are what anonymous users may do unless told
+// otherwise: list and download everywhere
+var defaultAnonymousPermissions = []PermissionRule{{Path: "/", Allow: PermRead}}
+
+// AnonymousAuthenticator accepts anonymous logins with any password and
+// delegates every other username to Next, if set
+type AnonymousAuthenticator struct {
+	Next Authenticator
+	// Permissions are what anonymous users may do. If empty, they may only
+	// list and download.
+	Permissions []PermissionRule
+}
+
+// Authenticate implements Authenticator
+func (a *AnonymousAuthenticator) Authenticate(username, password string) (*User, error) {
+	if isAnonymousName(username) {
+		perms := a.Permissions
+		if len(perms) == 0 {
+			perms = defaultAnonymousPermissions
+		}
+		return &User{Name: strings.ToLower(username), Anonymous: true, Permissions: perms}, nil
+	}
+	if a.Next == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return a.Next.Authenticate(username, password)
+}
+
+// HomeDirs implements HomeDirLister for the users Next knows about
+func (a *AnonymousAuthenticator) HomeDirs() []string {
+	if lister, ok := a.Next.(HomeDirLister); ok {
+		return lister.HomeDirs()
+	}
+	return nil
+}
+
+// FileAuthenticator authenticates users against a users file.
+//
+// Each non-empty line of the file has the form "username:hash", where hash
+// is a bcrypt hash as produced by HashPassword, optionally followed by
+// space separated key=value attributes:
+//
+//	download_rate  maximum download rate, e.g. 1M (see common.ParseRate)
+//	upload_rate    maximum upload rate
+//	allow          comma separated networks the user may log in from
+//	deny           comma separated networks the user may not log in from
+//	perms          [/path:]permissions, e.g. read or /incoming:list,upload;
+//	               may be repeated for different subtrees
+//	home           home directory the user is confined to, relative to the
+//	               server root unless absolute
+//
+// Lines starting with '#' are ignored.
+type FileAuthenticator struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]fileUser
+}
+
+// fileUser is an entry of a users file
+type fileUser struct {
+	hash string
+	user User
+}
+
+// NewFileAuthenticator loads a users file and returns an authenticator for it
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	a := &FileAuthenticator{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload re-reads the users file from disk
+func (a *FileAuthenticator) Reload() error {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return fmt.Errorf("cannot open users file: %w", err)
+	}
+	defer file.Close()
+
+	users := make(map[string]fileUser)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Split the line into the username, the password hash and any
+		// attributes
+		fields := strings.Fields(line)
+		name, hash, ok := strings.Cut(fields[0], ":")
+		if !ok || name == "" || hash == "" {
+			return fmt.Errorf("%s:%d: expected \"username:hash\"", a.path, lineNum)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("%s:%d: invalid password hash for %s: %w", a.path, lineNum, name, err)
+		}
+		if _, exists := users[name]; exists {
+			return fmt.Errorf("%s:%d: duplicate user %s", a.path, lineNum, name)
+		}
+
+		user := User{Name: name}
+		for _, attr := range fields[1:] {
+			if err := parseUserAttribute(&user, attr); err != nil {
+				return fmt.Errorf("%s:%d: %w", a.path, lineNum, err)
+			}
+		}
+		users[name] = fileUser{hash: hash, user: user}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading users file: %w", err)
+	}
+
+	a.mu.Lock()
+	a.users = users
+	a.mu.Unlock()
+	return nil
+}
+
+// Authenticate implements Authenticator
+func (a *FileAuthenticator) Authenticate(username, password string) (*User, error) {
+	a.mu.RLock()
+	entry, ok := a.users[username]
+	a.mu.RUnlock()
+
+	if !ok {
+		// Compare against a dummy hash so unknown users take as long to
+		// reject as known ones
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(entry.hash), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	user := entry.user
+	return &user, nil
+}
+
+// HomeDirs implements HomeDirLister
+func (a *FileAuthenticator) HomeDirs() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var dirs []string
+	for _, entry := range a.users {
+		if entry.user.HomeDir != "" {
+			dirs = append(dirs, entry.user.HomeDir)
+		}
+	}
+	return dirs
+}
+
+// parseUserAttribute applies a key=value attribute from a users file
+func parseUserAttribute(user *User, attr string) error {
+	key, value, ok := strings.Cut(attr, "=")
+	if !ok {
+		return fmt.Errorf("invalid attribute %q, expected key=value", attr)
+	}
+
+	switch key {
+	case "download_rate", "upload_rate":
+		rate, err := common.ParseRate(value)
+		if err != nil {
+			return err
+		}
+		if key == "download_rate" {
+			user.RateLimits.Download = rate
+		} else {
+			user.RateLimits.Upload = rate
+		}
+	case "home":
+		if value == "" {
+			return fmt.Errorf("empty home directory")
+		}
+		user.HomeDir = value
+	case "perms":
+		rule, err := ParsePermissionRule(value)
+		if err != nil {
+			return err
+		}
+		user.Permissions = append(user.Permissions, rule)
+	case "allow", "deny":
+		networks, err := parseCIDRs(strings.Split(value, ","))
+		if err != nil {
+			return err
+		}
+		if key == "allow" {
+			user.IPFilter.Allow = append(user.IPFilter.Allow, networks...)
+		} else {
+			user.IPFilter.Deny = append(user.IPFilter.Deny, networks...)
+		}
+	default:
+		return fmt.Errorf("unknown attribute %q", key)
+	}
+	return nil
+}
+
+// dummyHash is compared against when an unknown user tries to log in. It
+// has the default cost, like the hashes HashPassword makes.
+var dummyHash = []byte("$2a$10$Dzghfn8jiZSb8Le4l2XcF./pNd8besbNVQYx89MQW39tMgsqK4C8O")
+
+// HashPassword returns a salted bcrypt hash suitable for a users file
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
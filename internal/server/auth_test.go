@@ -0,0 +1,19 @@
+package server
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestDummyHash checks that rejecting an unknown user costs as much as
+// checking the password of a known one
+func TestDummyHash(t *testing.T) {
+	cost, err := bcrypt.Cost(dummyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != bcrypt.DefaultCost {
+		t.Errorf("dummy hash has cost %d, want %d", cost, bcrypt.DefaultCost)
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errAddressBanned is returned for connections from a banned address
+var errAddressBanned = errors.New("address temporarily banned")
+
+// maxLoginDelay caps the delay before rejecting a failed login
+const maxLoginDelay = 10 * time.Second
+
+// loginFailureWindow is how long failed logins are remembered after the
+// most recent one
+const loginFailureWindow = 15 * time.Minute
+
+// Ban is an address that is refused connections until a point in time
+type Ban struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
+
+// failureCount tracks consecutive failed logins for an address or user
+type failureCount struct {
+	count int
+	last  time.Time
+}
+
+// loginGuard slows down and bans clients that keep failing to log in.
+// Failures are tracked per address and per user name; the worse of the two
+// decides the delay before the 530 reply. Addresses with too many failures
+// are banned for a while.
+type loginGuard struct {
+	baseDelay   time.Duration
+	maxFailures int
+	banDuration time.Duration
+	// now returns the current time, so that tests can control it
+	now func() time.Time
+
+	mu        sync.Mutex
+	byIP      map[string]*failureCount
+	byUser    map[string]*failureCount
+	bans      map[string]time.Time
+	lastSweep time.Time
+}
+
+// newLoginGuard returns a guard delaying failed logins by baseDelay,
+// doubling with every further failure, and banning an address for
+// banDuration after maxFailures failures. A zero maxFailures disables bans.
+func newLoginGuard(baseDelay time.Duration, maxFailures int, banDuration time.Duration) *loginGuard {
+	return &loginGuard{
+		baseDelay:   baseDelay,
+		maxFailures: maxFailures,
+		banDuration: banDuration,
+		now:         time.Now,
+		byIP:        make(map[string]*failureCount),
+		byUser:      make(map[string]*failureCount),
+		bans:        make(map[string]time.Time),
+	}
+}
+
+// banned reports whether an address is currently banned
+func (g *loginGuard) banned(ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	until, ok := g.bans[ip]
+	if !ok {
+		return false
+	}
+	if g.now().After(until) {
+		delete(g.bans, ip)
+		return false
+	}
+	return true
+}
+
+// failure records a failed login and returns how long to wait before
+// replying, and whether the address has just been banned
+func (g *loginGuard) failure(ip, username string) (time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	g.sweep(now)
+
+	ipCount := g.count(g.byIP, ip, now)
+	userCount := g.count(g.byUser, username, now)
+
+	// Double the delay with every failure, up to the cap
+	failures := ipCount
+	if userCount > failures {
+		failures = userCount
+	}
+	delay := g.baseDelay
+	for i := 1; i < failures && delay < maxLoginDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxLoginDelay {
+		delay = maxLoginDelay
+	}
+
+	if g.maxFailures > 0 && ipCount >= g.maxFailures {
+		g.bans[ip] = now.Add(g.banDuration)
+		delete(g.byIP, ip)
+		return delay, true
+	}
+	return delay, false
+}
+
+// success forgets the failed logins of an address and user
+func (g *loginGuard) success(ip, username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.byIP, ip)
+	delete(g.byUser, username)
+}
+
+// list returns the active bans, soonest to expire first
+func (g *loginGuard) list() []Ban {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	bans := make([]Ban, 0, len(g.bans))
+	for ip, until := range g.bans {
+		if now.After(until) {
+			delete(g.bans, ip)
+			continue
+		}
+		bans = append(bans, Ban{IP: ip, Until: until})
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// count increments the failures for key, starting over if the previous
+// failure is too long ago, and returns the new count. The caller must hold
+// mu.
+func (g *loginGuard) count(counts map[string]*failureCount, key string, now time.Time) int {
+	c := counts[key]
+	if c == nil || now.Sub(c.last) > loginFailureWindow {
+		c = &failureCount{}
+		counts[key] = c
+	}
+	c.count++
+	c.last = now
+	return c.count
+}
+
+// sweep drops forgotten failures and expired bans, at most once a minute so
+// that the maps can't grow without bound. The caller must hold mu.
+func (g *loginGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < time.Minute {
+		return
+	}
+	g.lastSweep = now
+
+	for _, counts := range []map[string]*failureCount{g.byIP, g.byUser} {
+		for key, c := range counts {
+			if now.Sub(c.last) > loginFailureWindow {
+				delete(counts, key)
+			}
+		}
+	}
+	for ip, until := range g.bans {
+		if now.After(until) {
+			delete(g.bans, ip)
+		}
+	}
+}
+
+// Bans returns the addresses currently banned for failing to log in
+func (s *FTPServer) Bans() []Ban {
+	return s.guard.list()
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginGuard(t *testing.T) {
+	// step is a login attempt, made after advancing the clock
+	type step struct {
+		after   time.Duration
+		ip      string
+		user    string
+		success bool
+		// delay is the wanted delay of a failed attempt
+		delay time.Duration
+		// banned is whether the address should be banned afterwards
+		banned bool
+	}
+	tests := []struct {
+		name        string
+		maxFailures int
+		steps       []step
+	}{
+		{
+			name: "delay doubles up to the cap",
+			steps: []step{
+				{ip: "a", user: "u", delay: time.Second},
+				{ip: "a", user: "u", delay: 2 * time.Second},
+				{ip: "a", user: "u", delay: 4 * time.Second},
+				{ip: "a", user: "u", delay: 8 * time.Second},
+				{ip: "a", user: "u", delay: maxLoginDelay},
+			},
+		},
+		{
+			name:        "ban at the threshold",
+			maxFailures: 3,
+			steps: []step{
+				{ip: "a", user: "u", delay: time.Second},
+				{ip: "a", user: "v", delay: 2 * time.Second},
+				{ip: "b", user: "w", delay: time.Second},
+				{ip: "a", user: "w", delay: 4 * time.Second, banned: true},
+			},
+		},
+		{
+			name:        "failures for a user from many addresses",
+			maxFailures: 3,
+			steps: []step{
+				{ip: "a", user: "u", delay: time.Second},
+				{ip: "b", user: "u", delay: 2 * time.Second},
+				{ip: "c", user: "u", delay: 4 * time.Second},
+			},
+		},
+		{
+			name:        "success resets the count",
+			maxFailures: 3,
+			steps: []step{
+				{ip: "a", user: "u", delay: time.Second},
+				{ip: "a", user: "u", delay: 2 * time.Second},
+				{ip: "a", user: "u", success: true},
+				{ip: "a", user: "u", delay: time.Second},
+				{ip: "a", user: "u", delay: 2 * time.Second},
+			},
+		},
+		{
+			name:        "failures are forgotten",
+			maxFailures: 3,
+			steps: []step{
+				{ip: "a", user: "u", delay: time.Second},
+				{ip: "a", user: "u", delay: 2 * time.Second},
+				{after: loginFailureWindow + time.Second, ip: "a", user: "u", delay: time.Second},
+			},
+		},
+		{
+			name:        "bans expire",
+			maxFailures: 2,
+			steps: []step{
+				{ip: "a", user: "u", delay: time.Second},
+				{ip: "a", user: "u", delay: 2 * time.Second, banned: true},
+				{after: 10 * time.Minute, ip: "a", user: "u", success: true, banned: true},
+				{after: time.Second, ip: "a", user: "u", success: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			guard := newLoginGuard(time.Second, tt.maxFailures, 10*time.Minute)
+			guard.now = func() time.Time { return now }
+
+			for i, st := range tt.steps {
+				now = now.Add(st.after)
+				if st.success {
+					guard.success(st.ip, st.user)
+				} else if delay, _ := guard.failure(st.ip, st.user); delay != st.delay {
+					t.Errorf("step %d: delay %v, want %v", i, delay, st.delay)
+				}
+				if banned := guard.banned(st.ip); banned != st.banned {
+					t.Errorf("step %d: banned = %v, want %v", i, banned, st.banned)
+				}
+				if n := len(guard.list()); st.banned && n != 1 {
+					t.Errorf("step %d: %d bans listed", i, n)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// errNoDataConnection is returned when a transfer is requested without a
+// preceding PORT, EPRT, PASV or EPSV
+var errNoDataConnection = errors.New("no data connection set up")
+
+// errDataTimeout is returned when the client doesn't connect to a passive
+// listener in time
+var errDataTimeout = errors.New("timed out waiting for data connection")
+
+// dataChannel manages the data connection of a session.
+//
+// A passive listener is accepted on in the background. When a transfer
+// command arrives, open waits for that accept to finish, up to the
+// configured timeout. Listeners that are never connected to are closed
+// once the timeout expires, or when they are replaced or the channel is
+// closed.
+type dataChannel struct {
+	timeout time.Duration
+
+	mu      sync.Mutex
+	pending *pendingPassive
+	conn    net.Conn
+}
+
+// pendingPassive is a passive listener waiting for the client to connect
+type pendingPassive struct {
+	listener net.Listener
+	done     chan struct{}
+
+	// conn and err are only valid once done is closed
+	conn net.Conn
+	err  error
+}
+
+// newDataChannel creates a data channel that waits up to timeout for
+// passive connections
+func newDataChannel(timeout time.Duration) *dataChannel {
+	return &dataChannel{timeout: timeout}
+}
+
+// listen replaces any existing data connection with a passive listener and
+// starts accepting on it
+func (d *dataChannel) listen(listener net.Listener) {
+	p := &pendingPassive{
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+
+	// Don't let an abandoned listener hang around forever
+	if deadliner, ok := listener.(interface{ SetDeadline(time.Time) error }); ok {
+		deadliner.SetDeadline(time.Now().Add(d.timeout))
+	}
+
+	go func() {
+		defer close(p.done)
+		defer listener.Close()
+		p.conn, p.err = listener.Accept()
+	}()
+
+	d.mu.Lock()
+	old, oldConn := d.pending, d.conn
+	d.pending, d.conn = p, nil
+	d.mu.Unlock()
+
+	discard(old, oldConn)
+}
+
+// setConn replaces any existing data connection with an established one,
+// as used in active mode
+func (d *dataChannel) setConn(conn net.Conn) {
+	d.mu.Lock()
+	old, oldConn := d.pending, d.conn
+	d.pending, d.conn = nil, conn
+	d.mu.Unlock()
+
+	discard(old, oldConn)
+}
+
+// ready reports whether a data connection has been set up, even if the
+// client hasn't connected to it yet
+func (d *dataChannel) ready() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pending != nil || d.conn != nil
+}
+
+// open returns the data connection, waiting for a pending passive
+// connection if necessary. The connection stays owned by the data channel
+// and is closed by close.
+func (d *dataChannel) open() (net.Conn, error) {
+	d.mu.Lock()
+	p, conn := d.pending, d.conn
+	d.mu.Unlock()
+
+	if conn != nil {
+		return conn, nil
+	}
+	if p == nil {
+		return nil, errNoDataConnection
+	}
+
+	// Wait for the client to connect
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+	case <-timer.C:
+		p.listener.Close()
+		<-p.done
+		if p.conn != nil {
+			p.conn.Close()
+		}
+		return nil, errDataTimeout
+	}
+	if p.err != nil {
+		var netErr net.Error
+		if errors.As(p.err, &netErr) && netErr.Timeout() {
+			return nil, errDataTimeout
+		}
+		return nil, p.err
+	}
+
+	// Hand the accepted connection over, unless the channel was reset
+	// while we were waiting
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending != p {
+		p.conn.Close()
+		return nil, errNoDataConnection
+	}
+	d.pending, d.conn = nil, p.conn
+	return p.conn, nil
+}
+
+// upgrade replaces the established data connection with a wrapper around
+// it, such as a TLS connection, without closing the original
+func (d *dataChannel) upgrade(conn net.Conn) {
+	d.mu.Lock()
+	d.conn = conn
+	d.mu.Unlock()
+}
+
+// close closes the data connection and any pending listener
+func (d *dataChannel) close() {
+	d.mu.Lock()
+	old, oldConn := d.pending, d.conn
+	d.pending, d.conn = nil, nil
+	d.mu.Unlock()
+
+	discard(old, oldConn)
+}
+
+// discard closes a pending listener and an established connection. It
+// waits for the listener's accept to finish so a connection that raced in
+// isn't leaked.
+func discard(p *pendingPassive, conn net.Conn) {
+	if conn != nil {
+		conn.Close()
+	}
+	if p != nil {
+		p.listener.Close()
+		<-p.done
+		if p.conn != nil {
+			p.conn.Close()
+		}
+	}
+}
+
+// stallConn aborts reads and writes on a data connection that make no
+// progress for timeout, so a stalled client can't hold a transfer open
+type stallConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// Read implements net.Conn
+func (c *stallConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+// Write implements net.Conn
+func (c *stallConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+// watchStall applies the stall timeout to a data connection, if one is set
+func (s *FTPServer) watchStall(conn net.Conn) net.Conn {
+	if s.stall <= 0 {
+		return conn
+	}
+	return &stallConn{Conn: conn, timeout: s.stall}
+}
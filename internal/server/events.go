@@ -0,0 +1,334 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType identifies what happened in an Event
+type EventType string
+
+// Event types
+const (
+	EventLogin    EventType = "login"
+	EventLogout   EventType = "logout"
+	EventUpload   EventType = "upload"
+	EventDownload EventType = "download"
+	EventDelete   EventType = "delete"
+	EventRename   EventType = "rename"
+	EventMkdir    EventType = "mkdir"
+)
+
+// eventTypes are the known event types
+var eventTypes = []EventType{EventLogin, EventLogout, EventUpload, EventDownload, EventDelete, EventRename, EventMkdir}
+
+// ParseEventTypes parses a comma separated list of event types, such as
+// "upload,delete"
+func ParseEventTypes(s string) ([]EventType, error) {
+	var types []EventType
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		known := false
+		for _, t := range eventTypes {
+			if EventType(name) == t {
+				types = append(types, t)
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event %q", name)
+		}
+	}
+	return types, nil
+}
+
+// Event describes something a client did. Paths are virtual paths as the
+// user sees them.
+type Event struct {
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Session string    `json:"session"`
+	Remote  string    `json:"remote"`
+	User    string    `json:"user,omitempty"`
+	// Path is the file or directory acted on; for renames, the new name
+	Path string `json:"path,omitempty"`
+	// OldPath is the previous name of a renamed file or directory
+	OldPath string `json:"old_path,omitempty"`
+	// Size is the number of bytes transferred by uploads and downloads
+	Size int64 `json:"size,omitempty"`
+}
+
+// EventSink receives events. Send may be slow, as events are delivered in
+// the background; it should give up when ctx is done.
+type EventSink interface {
+	Send(ctx context.Context, event Event) error
+}
+
+// CommandSink runs a shell command for each event. The event is passed as
+// JSON on standard input and in ULTRAFTP_* environment variables, never in
+// the command line, so client supplied paths can't inject commands.
+type CommandSink struct {
+	// Command is run with "sh -c"
+	Command string
+}
+
+// Send runs the command and fails if it exits with a non-zero status
+func (c *CommandSink) Send(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", c.Command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		"ULTRAFTP_EVENT="+string(event.Type),
+		"ULTRAFTP_TIME="+event.Time.UTC().Format(time.RFC3339),
+		"ULTRAFTP_SESSION="+event.Session,
+		"ULTRAFTP_REMOTE="+event.Remote,
+		"ULTRAFTP_USER="+event.User,
+		"ULTRAFTP_PATH="+event.Path,
+		"ULTRAFTP_OLD_PATH="+event.OldPath,
+		"ULTRAFTP_SIZE="+strconv.FormatInt(event.Size, 10),
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(output) > 0 {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(truncate(output, 512))))
+		}
+		return err
+	}
+	return nil
+}
+
+// WebhookSink POSTs each event as JSON to a URL
+type WebhookSink struct {
+	URL string
+	// Client sends the requests. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Send posts the event and fails unless the reply is 2xx
+func (w *WebhookSink) Send(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "UltraFTP")
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook replied %s", resp.Status)
+	}
+	return nil
+}
+
+// truncate shortens b to at most n bytes
+func truncate(b []byte, n int) []byte {
+	if len(b) > n {
+		return b[:n]
+	}
+	return b
+}
+
+// DefaultEventQueueSize is the default for Options.EventQueueSize
+const DefaultEventQueueSize = 1000
+
+// DefaultEventTimeout is the default for Options.EventTimeout
+const DefaultEventTimeout = 10 * time.Second
+
+// eventRetryDelay is the delay before the first retry of a failed
+// delivery; it doubles with each further retry
+const eventRetryDelay = time.Second
+
+// eventDispatcher delivers events to sinks in the background. Each sink
+// has its own bounded queue and goroutine, so a slow sink neither holds
+// up the others nor the sessions; when a queue is full, new events for
+// that sink are dropped.
+type eventDispatcher struct {
+	logger  *slog.Logger
+	metrics *metrics
+	types   map[EventType]bool
+	retries int
+	timeout time.Duration
+	queues  []chan Event
+
+	// ctx is cancelled to abort deliveries when shutdown runs out of time
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// newEventDispatcher starts delivering events to sinks. Only events of the
+// given types are delivered, or all of them if types is empty.
+func newEventDispatcher(sinks []EventSink, types []EventType, queueSize, retries int, timeout time.Duration, logger *slog.Logger, m *metrics) *eventDispatcher {
+	if queueSize <= 0 {
+		queueSize = DefaultEventQueueSize
+	}
+	if timeout <= 0 {
+		timeout = DefaultEventTimeout
+	}
+
+	d := &eventDispatcher{
+		logger:  logger,
+		metrics: m,
+		retries: retries,
+		timeout: timeout,
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	if len(types) > 0 {
+		d.types = make(map[EventType]bool)
+		for _, t := range types {
+			d.types[t] = true
+		}
+	}
+
+	for _, sink := range sinks {
+		queue := make(chan Event, queueSize)
+		d.queues = append(d.queues, queue)
+		d.wg.Add(1)
+		go d.run(sink, queue)
+	}
+	return d
+}
+
+// publish queues an event for every sink without blocking
+func (d *eventDispatcher) publish(event Event) {
+	if d == nil || (d.types != nil && !d.types[event.Type]) {
+		return
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+	for _, queue := range d.queues {
+		select {
+		case queue <- event:
+		default:
+			d.logger.Warn("Event queue full, dropping event", "event", event.Type, "path", event.Path)
+			d.metrics.countEvent("dropped")
+		}
+	}
+}
+
+// run delivers the events of one sink until its queue is closed
+func (d *eventDispatcher) run(sink EventSink, queue chan Event) {
+	defer d.wg.Done()
+	for event := range queue {
+		// Shutdown ran out of time
+		if d.ctx.Err() != nil {
+			d.metrics.countEvent("dropped")
+			continue
+		}
+		d.deliver(sink, event)
+	}
+}
+
+// deliver sends an event to a sink, retrying with exponential backoff
+func (d *eventDispatcher) deliver(sink EventSink, event Event) {
+	delay := eventRetryDelay
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(d.ctx, d.timeout)
+		err := sink.Send(ctx, event)
+		cancel()
+		if err == nil {
+			d.metrics.countEvent("delivered")
+			return
+		}
+
+		if attempt >= d.retries || d.ctx.Err() != nil {
+			d.logger.Error("Event delivery failed", "event", event.Type, "path", event.Path, "sink", fmt.Sprintf("%T", sink), "error", err)
+			d.metrics.countEvent("failed")
+			return
+		}
+		d.logger.Warn("Event delivery failed, retrying", "event", event.Type, "sink", fmt.Sprintf("%T", sink), "error", err, "retry_in", delay)
+
+		select {
+		case <-time.After(delay):
+		case <-d.ctx.Done():
+		}
+		delay *= 2
+	}
+}
+
+// close stops accepting events and waits for the queued ones to be
+// delivered. Once ctx is done, deliveries in progress are aborted and the
+// remaining events are dropped.
+func (d *eventDispatcher) close(ctx context.Context) error {
+	if d == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		for _, queue := range d.queues {
+			close(queue)
+		}
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// emit publishes an event about a session
+func (s *FTPServer) emit(session *Session, event Event) {
+	if s.events == nil {
+		return
+	}
+
+	event.Time = time.Now()
+	event.Session = session.id
+	event.Remote = addrIP(session.netConn.RemoteAddr()).String()
+	if session.user != nil {
+		event.User = session.user.Name
+	}
+	s.events.publish(event)
+}
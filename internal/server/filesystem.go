@@ -0,0 +1,251 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// FileSystem is the storage the server serves files from.
+//
+// Names are virtual paths: absolute, slash separated and clean, with "/"
+// standing for the root of the file system. Errors should wrap
+// fs.ErrNotExist, fs.ErrExist and fs.ErrPermission where they apply, so
+// the server can tell the client what went wrong.
+type FileSystem interface {
+	// Stat returns information about a file or directory
+	Stat(name string) (fs.FileInfo, error)
+	// ReadDir returns the entries of a directory, sorted by name
+	ReadDir(name string) ([]fs.FileInfo, error)
+	// Open opens a file for reading
+	Open(name string) (File, error)
+	// OpenFile opens a file with the given os.O_* flags, creating it with
+	// perm if os.O_CREATE is set
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	// Mkdir creates a directory. Its parent must exist.
+	Mkdir(name string, perm fs.FileMode) error
+	// Remove removes a file or an empty directory
+	Remove(name string) error
+	// Rename moves a file or directory, replacing any file at newName
+	Rename(oldName, newName string) error
+}
+
+// File is an open file of a FileSystem. *os.File implements it.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Stat() (fs.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// Aborter is implemented by files that only store what was written to them
+// once they are closed. Abort closes such a file without storing anything,
+// leaving any previous contents as they were. It does nothing after Close.
+type Aborter interface {
+	Abort() error
+}
+
+// abortFile closes a file whose contents are incomplete, discarding them if
+// the file supports it
+func abortFile(file File) error {
+	if a, ok := file.(Aborter); ok {
+		return a.Abort()
+	}
+	return file.Close()
+}
+
+// AtomicCreator is implemented by file systems on which a new file only
+// appears, complete, once it is closed, and replaces any previous version
+// in one step. Uploads to them are written in place rather than to a
+// temporary file that is renamed into place.
+type AtomicCreator interface {
+	// AtomicCreate reports whether writing name is atomic
+	AtomicCreate(name string) bool
+}
+
+// createsAtomically reports whether fsys writes name atomically
+func createsAtomically(fsys FileSystem, name string) bool {
+	a, ok := fsys.(AtomicCreator)
+	return ok && a.AtomicCreate(name)
+}
+
+// ReadOnlyReporter is implemented by file systems that refuse to modify
+// some or all of their files with ErrReadOnly, so that clients can be told
+// up front what they can't change
+type ReadOnlyReporter interface {
+	// IsReadOnly reports whether name can't be modified
+	IsReadOnly(name string) bool
+}
+
+// isReadOnly reports whether fsys refuses to modify name
+func isReadOnly(fsys FileSystem, name string) bool {
+	r, ok := fsys.(ReadOnlyReporter)
+	return ok && r.IsReadOnly(name)
+}
+
+// SubFileSystem is implemented by file systems that can provide a view of
+// one of their directories more efficiently or more strictly than the
+// generic wrapper returned by Sub
+type SubFileSystem interface {
+	FileSystem
+	// Sub returns a file system rooted at dir
+	Sub(dir string) (FileSystem, error)
+}
+
+// ErrReadOnly is returned by read-only file systems for any operation that
+// would modify them
+var ErrReadOnly = errors.New("read-only file system")
+
+// Sub returns a file system rooted at dir, which must be a directory of
+// fsys. Paths in the returned file system can't reach outside dir.
+func Sub(fsys FileSystem, dir string) (FileSystem, error) {
+	dir = path.Clean("/" + dir)
+	if dir == "/" {
+		return fsys, nil
+	}
+	if sub, ok := fsys.(SubFileSystem); ok {
+		return sub.Sub(dir)
+	}
+
+	info, err := fsys.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: errNotDir}
+	}
+	return &subFileSystem{fsys: fsys, dir: dir}, nil
+}
+
+// errNotDir is returned when a directory was expected
+var errNotDir = errors.New("not a directory")
+
+// subFileSystem is a view of a directory of another file system
+type subFileSystem struct {
+	fsys FileSystem
+	dir  string
+}
+
+// full maps a name in the view to a name in the underlying file system.
+// Names are clean and absolute, so they can't climb out of the directory.
+func (f *subFileSystem) full(name string) string {
+	return path.Join(f.dir, name)
+}
+
+func (f *subFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return f.fsys.Stat(f.full(name))
+}
+
+func (f *subFileSystem) ReadDir(name string) ([]fs.FileInfo, error) {
+	return f.fsys.ReadDir(f.full(name))
+}
+
+func (f *subFileSystem) Open(name string) (File, error) {
+	return f.fsys.Open(f.full(name))
+}
+
+func (f *subFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	return f.fsys.OpenFile(f.full(name), flag, perm)
+}
+
+func (f *subFileSystem) Mkdir(name string, perm fs.FileMode) error {
+	return f.fsys.Mkdir(f.full(name), perm)
+}
+
+func (f *subFileSystem) Remove(name string) error {
+	return f.fsys.Remove(f.full(name))
+}
+
+func (f *subFileSystem) Rename(oldName, newName string) error {
+	return f.fsys.Rename(f.full(oldName), f.full(newName))
+}
+
+func (f *subFileSystem) AtomicCreate(name string) bool {
+	return createsAtomically(f.fsys, f.full(name))
+}
+
+func (f *subFileSystem) IsReadOnly(name string) bool {
+	return isReadOnly(f.fsys, f.full(name))
+}
+
+// ReadOnly wraps a file system so that every operation that would modify
+// it fails with ErrReadOnly
+func ReadOnly(fsys FileSystem) FileSystem {
+	if _, ok := fsys.(readOnlyFileSystem); ok {
+		return fsys
+	}
+	return readOnlyFileSystem{fsys: fsys}
+}
+
+// readOnlyFileSystem refuses writes to the file system it wraps
+type readOnlyFileSystem struct {
+	fsys FileSystem
+}
+
+func (f readOnlyFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return f.fsys.Stat(name)
+}
+
+func (f readOnlyFileSystem) ReadDir(name string) ([]fs.FileInfo, error) {
+	return f.fsys.ReadDir(name)
+}
+
+func (f readOnlyFileSystem) Open(name string) (File, error) {
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return readOnlyFile{file}, nil
+}
+
+func (f readOnlyFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: ErrReadOnly}
+	}
+	return f.Open(name)
+}
+
+func (f readOnlyFileSystem) Mkdir(name string, perm fs.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: ErrReadOnly}
+}
+
+func (f readOnlyFileSystem) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: ErrReadOnly}
+}
+
+func (f readOnlyFileSystem) Rename(oldName, newName string) error {
+	return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: ErrReadOnly}
+}
+
+func (f readOnlyFileSystem) AtomicCreate(name string) bool {
+	return createsAtomically(f.fsys, name)
+}
+
+func (f readOnlyFileSystem) IsReadOnly(name string) bool {
+	return true
+}
+
+func (f readOnlyFileSystem) Sub(dir string) (FileSystem, error) {
+	sub, err := Sub(f.fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	return ReadOnly(sub), nil
+}
+
+// readOnlyFile refuses writes to the file it wraps
+type readOnlyFile struct {
+	File
+}
+
+func (f readOnlyFile) Write(p []byte) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (f readOnlyFile) Truncate(size int64) error {
+	return ErrReadOnly
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// errAddressNotAllowed is returned for connections from an address the IP
+// filter rejects
+var errAddressNotAllowed = errors.New("address not allowed")
+
+// IPFilter restricts addresses by CIDR. An address is permitted if it
+// matches no Deny network and, when Allow isn't empty, at least one Allow
+// network. The zero value permits everything.
+type IPFilter struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// ParseIPFilter builds a filter from lists of CIDRs. Plain addresses are
+// accepted as single-host networks.
+func ParseIPFilter(allow, deny []string) (IPFilter, error) {
+	var filter IPFilter
+	var err error
+	if filter.Allow, err = parseCIDRs(allow); err != nil {
+		return IPFilter{}, err
+	}
+	if filter.Deny, err = parseCIDRs(deny); err != nil {
+		return IPFilter{}, err
+	}
+	return filter, nil
+}
+
+// parseCIDRs parses a list of CIDRs or plain addresses
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Permits reports whether the filter lets an address through
+func (f IPFilter) Permits(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	// Treat IPv4-mapped IPv6 addresses as the IPv4 addresses they are
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, network := range f.Deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	for _, network := range f.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// permitsDataAddress reports whether a session may open an active mode data
+// connection to ip. The target has to pass both the server's filter and the
+// user's, so PORT can't be used to reach hosts the client couldn't.
+func (s *FTPServer) permitsDataAddress(session *Session, ip net.IP) bool {
+	if !s.ipFilter.Permits(ip) {
+		return false
+	}
+	if session.user != nil && !session.user.IPFilter.Permits(ip) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// mlstFacts are the RFC 3659 facts the server can report, in order
+var mlstFacts = []string{"type", "size", "modify", "perm", "unique"}
+
+// mlstTimeFormat is the time format used by MDTM and the modify fact
+const mlstTimeFormat = "20060102150405"
+
+// mlstFeature returns the MLST line for the FEAT reply, with the facts
+// enabled by default marked with '*'
+func mlstFeature() string {
+	var b strings.Builder
+	b.WriteString("MLST ")
+	for _, fact := range mlstFacts {
+		b.WriteString(fact + "*;")
+	}
+	return b.String()
+}
+
+// handleNameList handles the NLST command, which lists names only
+func (s *FTPServer) handleNameList(session *Session, param string) {
+	if !session.data.ready() {
+		session.writeResponse(425, "Use PORT or PASV first")
+		return
+	}
+
+	// Ensure the data connection is closed when we're done
+	defer session.data.close()
+
+	// Determine the directory to list, ignoring any ls-style options
+	listPath := param
+	if strings.HasPrefix(listPath, "-") {
+		_, listPath, _ = strings.Cut(listPath, " ")
+	}
+
+	virtualPath := session.resolvePath(listPath)
+	if !session.can(virtualPath, PermList) {
+		return
+	}
+
+	info, err := session.fs.Stat(virtualPath)
+	if err != nil {
+		session.writeResponse(550, "File not found")
+		return
+	}
+
+	// A file lists as itself, a directory as its entries
+	var names []string
+	if info.IsDir() {
+		entries, err := session.readDir(virtualPath)
+		if err != nil {
+			session.writeResponse(550, "Error reading directory")
+			return
+		}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+	} else {
+		names = append(names, listPath)
+	}
+
+	session.writeResponse(150, "Here comes the name list")
+
+	// Wait for the client to connect if it hasn't already
+	dataConn, err := s.openData(session)
+	if err != nil {
+		session.log().Warn("Error opening data connection", "error", err)
+		session.writeResponse(425, "Cannot open data connection")
+		return
+	}
+
+	writer := bufio.NewWriter(dataConn)
+	for _, name := range names {
+		fmt.Fprintf(writer, "%s\r\n", name)
+	}
+	if err := writer.Flush(); err != nil {
+		session.writeResponse(426, "Connection closed; transfer aborted")
+		return
+	}
+
+	session.writeResponse(226, "Name list send OK")
+}
+
+// handleMachineList handles the MLSD command (RFC 3659)
+func (s *FTPServer) handleMachineList(session *Session, param string) {
+	if !session.data.ready() {
+		session.writeResponse(425, "Use PORT or PASV first")
+		return
+	}
+
+	// Ensure the data connection is closed when we're done
+	defer session.data.close()
+
+	virtualPath := session.resolvePath(param)
+	if !session.can(virtualPath, PermList) {
+		return
+	}
+
+	info, err := session.fs.Stat(virtualPath)
+	if err != nil {
+		session.writeResponse(550, "Directory not found")
+		return
+	}
+	if !info.IsDir() {
+		session.writeResponse(501, "Not a directory")
+		return
+	}
+
+	entries, err := session.readDir(virtualPath)
+	if err != nil {
+		session.writeResponse(550, "Error reading directory")
+		return
+	}
+
+	session.writeResponse(150, "Here comes the directory listing")
+
+	// Wait for the client to connect if it hasn't already
+	dataConn, err := s.openData(session)
+	if err != nil {
+		session.log().Warn("Error opening data connection", "error", err)
+		session.writeResponse(425, "Cannot open data connection")
+		return
+	}
+
+	// The directory itself comes first, followed by its entries
+	writer := bufio.NewWriter(dataConn)
+	fmt.Fprintf(writer, "%s .\r\n", session.mlstFacts(info, virtualPath, "cdir"))
+	for _, entry := range entries {
+		entryPath := path.Join(virtualPath, entry.Name())
+		fmt.Fprintf(writer, "%s %s\r\n", session.mlstFacts(entry, entryPath, ""), entry.Name())
+	}
+	if err := writer.Flush(); err != nil {
+		session.writeResponse(426, "Connection closed; transfer aborted")
+		return
+	}
+
+	session.writeResponse(226, "Directory send OK")
+}
+
+// handleMachineListSingle handles the MLST command, which describes a single
+// file over the control connection
+func (s *FTPServer) handleMachineListSingle(session *Session, param string) {
+	virtualPath := session.resolvePath(param)
+	if !session.can(virtualPath, PermList) {
+		return
+	}
+
+	info, err := session.fs.Stat(virtualPath)
+	if err != nil {
+		session.writeResponse(550, "File not found")
+		return
+	}
+
+	session.writeMultiResponse(250, []string{
+		"Listing " + virtualPath,
+		fmt.Sprintf("%s %s", session.mlstFacts(info, virtualPath, ""), virtualPath),
+		"End",
+	})
+}
+
+// handleModTime handles the MDTM command (RFC 3659)
+func (s *FTPServer) handleModTime(session *Session, param string) {
+	virtualPath := session.resolvePath(param)
+	if !session.can(virtualPath, PermList) {
+		return
+	}
+
+	info, err := session.fs.Stat(virtualPath)
+	if err != nil {
+		session.writeResponse(550, "File not found")
+		return
+	}
+	if !info.Mode().IsRegular() {
+		session.writeResponse(550, "Not a regular file")
+		return
+	}
+
+	session.writeResponse(213, info.ModTime().UTC().Format(mlstTimeFormat))
+}
+
+// handleOptions handles the OPTS command
+func (s *FTPServer) handleOptions(session *Session, param string) {
+	option, value, _ := strings.Cut(param, " ")
+
+	switch strings.ToUpper(option) {
+	case "UTF8":
+		// Paths are always UTF-8
+		session.writeResponse(200, "UTF8 mode always enabled")
+	case "MLST":
+		// Select the facts reported by MLST and MLSD, ignoring unknown ones.
+		// An empty list selects no facts at all.
+		selected := []string{}
+		for _, fact := range strings.Split(value, ";") {
+			fact = strings.ToLower(strings.TrimSpace(fact))
+			for _, known := range mlstFacts {
+				if fact == known {
+					selected = append(selected, fact)
+				}
+			}
+		}
+		session.mlstSelected = selected
+		reply := "MLST OPTS"
+		if len(selected) > 0 {
+			reply += " " + strings.Join(selected, ";") + ";"
+		}
+		session.writeResponse(200, reply)
+	default:
+		session.writeResponse(501, "Option not understood")
+	}
+}
+
+// mlstFacts formats the selected facts of a file. kind overrides the type
+// fact, as used for the "cdir" entry of MLSD.
+func (s *Session) mlstFacts(info fs.FileInfo, virtualPath, kind string) string {
+	selected := s.mlstSelected
+	if selected == nil {
+		selected = mlstFacts
+	}
+
+	var b strings.Builder
+	for _, fact := range selected {
+		switch fact {
+		case "type":
+			if kind == "" {
+				kind = "file"
+				if info.IsDir() {
+					kind = "dir"
+				}
+			}
+			fmt.Fprintf(&b, "type=%s;", kind)
+		case "size":
+			fmt.Fprintf(&b, "size=%d;", info.Size())
+		case "modify":
+			fmt.Fprintf(&b, "modify=%s;", info.ModTime().UTC().Format(mlstTimeFormat))
+		case "perm":
+			fmt.Fprintf(&b, "perm=%s;", s.mlstPerm(info, virtualPath))
+		case "unique":
+			fmt.Fprintf(&b, "unique=%s;", uniqueID(virtualPath))
+		}
+	}
+	return b.String()
+}
+
+// mlstPerm returns the perm fact of a file: what the client may do with it
+func (s *Session) mlstPerm(info fs.FileInfo, virtualPath string) string {
+	here := s.permissions.at(virtualPath)
+	parent := s.permissions.at(path.Dir(virtualPath))
+
+	// Whatever the user may do, nothing changes on a read-only file system
+	if isReadOnly(s.fs, virtualPath) {
+		here &= PermRead
+		parent &= PermRead
+	}
+
+	var b strings.Builder
+	add := func(letter string, allowed bool) {
+		if allowed {
+			b.WriteString(letter)
+		}
+	}
+
+	if info.IsDir() {
+		// enter, list, create files, make directories, purge, delete, rename
+		add("e", true)
+		add("l", here&PermList != 0)
+		add("c", here&PermUpload != 0)
+		add("m", here&PermMkdir != 0)
+		add("p", here&PermDelete != 0)
+		add("d", parent&PermDelete != 0)
+		add("f", parent&PermRename != 0)
+		return b.String()
+	}
+
+	// append, delete, rename, retrieve, write
+	add("a", here&PermOverwrite != 0)
+	add("d", parent&PermDelete != 0)
+	add("f", parent&PermRename != 0)
+	add("r", here&PermDownload != 0)
+	add("w", here&PermOverwrite != 0)
+	return b.String()
+}
+
+// uniqueID returns a stable identifier for a file, derived from its path
+func uniqueID(virtualPath string) string {
+	h := fnv.New64a()
+	h.Write([]byte(virtualPath))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// NewLogger returns a logger writing to w at the given level ("debug",
+// "info", "warn" or "error") in the given format ("text" or "json")
+func NewLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expected text or json", format)
+	}
+}
+
+// newSessionID returns a short random identifier used to correlate the log
+// records of a session
+func newSessionID() string {
+	var b [6]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "000000000000"
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// redactParam hides the arguments of commands that carry secrets, so they
+// never reach the logs
+func redactParam(command, param string) string {
+	if command == "PASS" && param != "" {
+		return "[REDACTED]"
+	}
+	return param
+}
+
+// log returns the session's logger, annotated with the user once known
+func (s *Session) log() *slog.Logger {
+	switch {
+	case s.user != nil:
+		return s.logger.With("user", s.user.Name)
+	case s.pendingUser != "":
+		return s.logger.With("user", s.pendingUser)
+	default:
+		return s.logger
+	}
+}
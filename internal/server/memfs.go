@@ -0,0 +1,399 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNotEmpty is returned when removing a directory that has entries
+var errNotEmpty = errors.New("directory not empty")
+
+// MemFileSystem keeps files in memory. It is meant for tests and for
+// ephemeral drop zones whose contents may be lost when the server stops.
+// It is safe for concurrent use.
+type MemFileSystem struct {
+	mu   sync.RWMutex
+	root *memNode
+}
+
+// memNode is a file or directory of a MemFileSystem
+type memNode struct {
+	name     string
+	mode     fs.FileMode
+	modTime  time.Time
+	data     []byte
+	children map[string]*memNode
+}
+
+// NewMemFileSystem returns an empty in-memory file system
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{root: newMemDir("/", 0755)}
+}
+
+// newMemDir returns an empty directory node
+func newMemDir(name string, perm fs.FileMode) *memNode {
+	return &memNode{
+		name:     name,
+		mode:     fs.ModeDir | perm.Perm(),
+		modTime:  time.Now(),
+		children: make(map[string]*memNode),
+	}
+}
+
+// info returns a snapshot of the node's metadata. The caller must hold the
+// file system's lock.
+func (n *memNode) info() fs.FileInfo {
+	return &memFileInfo{
+		name:    n.name,
+		size:    int64(len(n.data)),
+		mode:    n.mode,
+		modTime: n.modTime,
+	}
+}
+
+// lookup returns the node at a virtual path. The caller must hold the lock.
+func (f *MemFileSystem) lookup(op, name string) (*memNode, error) {
+	node := f.root
+	for _, part := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if !node.mode.IsDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errNotDir}
+		}
+		child, ok := node.children[part]
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// lookupParent returns the directory that contains a virtual path and the
+// path's last element. The caller must hold the lock.
+func (f *MemFileSystem) lookupParent(op, name string) (*memNode, string, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	dir, base := path.Split(name)
+	parent, err := f.lookup(op, dir)
+	if err != nil {
+		return nil, "", err
+	}
+	if !parent.mode.IsDir() {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: errNotDir}
+	}
+	return parent, base, nil
+}
+
+func (f *MemFileSystem) Stat(name string) (fs.FileInfo, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	node, err := f.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(), nil
+}
+
+func (f *MemFileSystem) ReadDir(name string) ([]fs.FileInfo, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	node, err := f.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+
+	infos := make([]fs.FileInfo, 0, len(node.children))
+	for _, child := range node.children {
+		infos = append(infos, child.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (f *MemFileSystem) Open(name string) (File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *MemFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	node, err := f.lookup("open", name)
+	switch {
+	case err == nil:
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+		}
+	case errors.Is(err, fs.ErrNotExist) && flag&os.O_CREATE != 0:
+		parent, base, err := f.lookupParent("open", name)
+		if err != nil {
+			return nil, err
+		}
+		node = &memNode{name: base, mode: perm.Perm(), modTime: time.Now()}
+		parent.children[base] = node
+		parent.modTime = node.modTime
+	default:
+		return nil, err
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if node.mode.IsDir() && writable {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	if writable && flag&os.O_TRUNC != 0 {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+
+	return &memFile{
+		fs:       f,
+		node:     node,
+		name:     name,
+		readable: flag&os.O_WRONLY == 0,
+		writable: writable,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (f *MemFileSystem) Mkdir(name string, perm fs.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parent, base, err := f.lookupParent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if _, ok := parent.children[base]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+
+	dir := newMemDir(base, perm)
+	parent.children[base] = dir
+	parent.modTime = dir.modTime
+	return nil
+}
+
+func (f *MemFileSystem) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parent, base, err := f.lookupParent("remove", name)
+	if err != nil {
+		return err
+	}
+	node, ok := parent.children[base]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if len(node.children) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+	}
+
+	delete(parent.children, base)
+	parent.modTime = time.Now()
+	return nil
+}
+
+func (f *MemFileSystem) Rename(oldName, newName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	linkError := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+
+	oldParent, oldBase, err := f.lookupParent("rename", oldName)
+	if err != nil {
+		return err
+	}
+	node, ok := oldParent.children[oldBase]
+	if !ok {
+		return linkError(fs.ErrNotExist)
+	}
+
+	// A directory can't be moved into itself
+	oldClean, newClean := path.Clean("/"+oldName), path.Clean("/"+newName)
+	if oldClean == newClean {
+		return nil
+	}
+	if node.mode.IsDir() && isWithinVirtual(oldClean, newClean) {
+		return linkError(fs.ErrInvalid)
+	}
+
+	newParent, newBase, err := f.lookupParent("rename", newName)
+	if err != nil {
+		return err
+	}
+
+	// Like rename(2), only replace a file with a file or an empty
+	// directory with a directory
+	if existing, ok := newParent.children[newBase]; ok {
+		switch {
+		case existing.mode.IsDir() && !node.mode.IsDir():
+			return linkError(errors.New("is a directory"))
+		case !existing.mode.IsDir() && node.mode.IsDir():
+			return linkError(errNotDir)
+		case len(existing.children) > 0:
+			return linkError(errNotEmpty)
+		}
+	}
+
+	now := time.Now()
+	delete(oldParent.children, oldBase)
+	node.name = newBase
+	newParent.children[newBase] = node
+	oldParent.modTime = now
+	newParent.modTime = now
+	return nil
+}
+
+// memFile is an open file of a MemFileSystem
+type memFile struct {
+	fs       *MemFileSystem
+	node     *memNode
+	name     string
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if !f.readable || f.node.mode.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrPermission}
+	}
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+
+	// Grow the file, filling any gap left by seeking past the end
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		if end > int64(cap(f.node.data)) {
+			grown := make([]byte, len(f.node.data), end+end/4)
+			copy(grown, f.node.data)
+			f.node.data = grown
+		}
+		f.node.data = f.node.data[:end]
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+
+	if f.closed {
+		return nil, fs.ErrClosed
+	}
+	return f.node.info(), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return fs.ErrClosed
+	}
+	if !f.writable || size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// memFileInfo describes a file of a MemFileSystem
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() any           { return nil }
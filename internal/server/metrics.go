@@ -0,0 +1,297 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transferDurationBuckets are the upper bounds, in seconds, of the transfer
+// duration histogram
+var transferDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900}
+
+// implementedCommands are the verbs counted under their own name in the
+// command metrics; anything else is counted as OTHER so that clients can't
+// create arbitrary label values
+var implementedCommands = map[string]bool{
+	"USER": true, "PASS": true, "SYST": true, "FEAT": true, "AUTH": true,
+	"PBSZ": true, "PROT": true, "NOOP": true, "PWD": true, "TYPE": true,
+	"PASV": true, "PORT": true, "EPSV": true, "EPRT": true, "LIST": true,
+	"NLST": true, "MLSD": true, "MLST": true, "MDTM": true, "OPTS": true,
+	"RETR": true, "STOR": true, "APPE": true, "REST": true, "SIZE": true,
+	"CWD": true, "CDUP": true, "MKD": true, "XMKD": true, "RMD": true,
+	"XRMD": true, "DELE": true, "RNFR": true, "RNTO": true, "QUIT": true,
+}
+
+// commandKey identifies a command counter
+type commandKey struct {
+	command string
+	code    int
+}
+
+// histogram is a Prometheus-style cumulative histogram
+type histogram struct {
+	counts []uint64 // one per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// observe adds a value to the histogram
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(transferDurationBuckets))
+	}
+	for i, bound := range transferDurationBuckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// metrics collects the server's usage statistics
+type metrics struct {
+	mu               sync.Mutex
+	commands         map[commandKey]uint64
+	bytes            map[string]uint64
+	durations        map[string]*histogram
+	transfers        map[string]uint64
+	loginFailures    uint64
+	passiveActive    int64
+	passiveTotal     uint64
+	passiveExhausted uint64
+	events           map[string]uint64
+}
+
+// newMetrics returns an empty set of metrics
+func newMetrics() *metrics {
+	return &metrics{
+		commands:  make(map[commandKey]uint64),
+		bytes:     make(map[string]uint64),
+		durations: make(map[string]*histogram),
+		transfers: make(map[string]uint64),
+		events:    make(map[string]uint64),
+	}
+}
+
+// countCommand records a command and the final reply code sent for it
+func (m *metrics) countCommand(command string, code int) {
+	if !implementedCommands[command] {
+		command = "OTHER"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands[commandKey{command, code}]++
+}
+
+// countTransfer records a file transfer in the given direction
+func (m *metrics) countTransfer(direction string, bytes int64, duration time.Duration, completed bool) {
+	status := "aborted"
+	if completed {
+		status = "completed"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes[direction] += uint64(bytes)
+	m.transfers[direction+"/"+status]++
+	h := m.durations[direction]
+	if h == nil {
+		h = &histogram{}
+		m.durations[direction] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// countLoginFailure records a failed login
+func (m *metrics) countLoginFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loginFailures++
+}
+
+// countEvent records the outcome of an event delivery: "delivered",
+// "failed" or "dropped"
+func (m *metrics) countEvent(status string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events[status]++
+}
+
+// countPassiveListener records a passive listener being opened (delta 1)
+// or closed (delta -1)
+func (m *metrics) countPassiveListener(delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.passiveActive += delta
+	if delta > 0 {
+		m.passiveTotal++
+	}
+}
+
+// countPassiveExhausted records a PASV that failed for lack of free ports
+func (m *metrics) countPassiveExhausted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.passiveExhausted++
+}
+
+// metricsListener decrements the active passive listener count once when
+// the listener is closed
+type metricsListener struct {
+	net.Listener
+	metrics *metrics
+	once    sync.Once
+}
+
+// Close closes the listener and updates the metrics
+func (l *metricsListener) Close() error {
+	l.once.Do(func() { l.metrics.countPassiveListener(-1) })
+	return l.Listener.Close()
+}
+
+// SetDeadline passes deadlines through to the underlying listener, which the
+// data channel uses to time out waiting clients
+func (l *metricsListener) SetDeadline(t time.Time) error {
+	if d, ok := l.Listener.(interface{ SetDeadline(time.Time) error }); ok {
+		return d.SetDeadline(t)
+	}
+	return nil
+}
+
+// trackPassive wraps a passive listener so it is counted while open
+func (m *metrics) trackPassive(listener net.Listener) net.Listener {
+	m.countPassiveListener(1)
+	return &metricsListener{Listener: listener, metrics: m}
+}
+
+// MetricsHandler returns an HTTP handler serving the server's metrics in the
+// Prometheus text format on /metrics, a health check on /healthz that
+// succeeds while the server is accepting connections, and the active bans
+// as JSON on /bans
+func (s *FTPServer) MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.writeMetrics(w)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		s.sessionsMu.Lock()
+		healthy := s.listener != nil && !s.closing
+		s.sessionsMu.Unlock()
+
+		if !healthy {
+			http.Error(w, "not serving", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+	mux.HandleFunc("/bans", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Bans())
+	})
+	return mux
+}
+
+// writeMetrics writes all metrics in the Prometheus text format
+func (s *FTPServer) writeMetrics(w io.Writer) {
+	s.sessionsMu.Lock()
+	sessions := len(s.sessions)
+	s.sessionsMu.Unlock()
+	bans := s.Bans()
+
+	m := s.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "ultraftp_sessions_active", "gauge", "Number of connected client sessions.")
+	fmt.Fprintf(w, "ultraftp_sessions_active %d\n", sessions)
+
+	writeHeader(w, "ultraftp_commands_total", "counter", "Commands handled, by verb and final reply code.")
+	keys := make([]commandKey, 0, len(m.commands))
+	for key := range m.commands {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].command != keys[j].command {
+			return keys[i].command < keys[j].command
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "ultraftp_commands_total{command=%s,code=\"%d\"} %d\n", quoteLabel(key.command), key.code, m.commands[key])
+	}
+
+	writeHeader(w, "ultraftp_transfer_bytes_total", "counter", "File transfer bytes, by direction.")
+	for _, direction := range []string{"sent", "received"} {
+		fmt.Fprintf(w, "ultraftp_transfer_bytes_total{direction=%q} %d\n", direction, m.bytes[direction])
+	}
+
+	writeHeader(w, "ultraftp_transfers_total", "counter", "File transfers, by direction and outcome.")
+	for _, direction := range []string{"sent", "received"} {
+		for _, status := range []string{"completed", "aborted"} {
+			fmt.Fprintf(w, "ultraftp_transfers_total{direction=%q,status=%q} %d\n", direction, status, m.transfers[direction+"/"+status])
+		}
+	}
+
+	writeHeader(w, "ultraftp_transfer_duration_seconds", "histogram", "File transfer durations, by direction.")
+	for _, direction := range []string{"sent", "received"} {
+		h := m.durations[direction]
+		if h == nil {
+			h = &histogram{}
+		}
+		var cumulative uint64
+		for i, bound := range transferDurationBuckets {
+			if h.counts != nil {
+				cumulative += h.counts[i]
+			}
+			fmt.Fprintf(w, "ultraftp_transfer_duration_seconds_bucket{direction=%q,le=%q} %d\n", direction, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "ultraftp_transfer_duration_seconds_bucket{direction=%q,le=\"+Inf\"} %d\n", direction, h.count)
+		fmt.Fprintf(w, "ultraftp_transfer_duration_seconds_sum{direction=%q} %s\n", direction, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "ultraftp_transfer_duration_seconds_count{direction=%q} %d\n", direction, h.count)
+	}
+
+	writeHeader(w, "ultraftp_login_failures_total", "counter", "Failed login attempts.")
+	fmt.Fprintf(w, "ultraftp_login_failures_total %d\n", m.loginFailures)
+
+	writeHeader(w, "ultraftp_bans_active", "gauge", "Addresses currently banned for failing to log in.")
+	fmt.Fprintf(w, "ultraftp_bans_active %d\n", len(bans))
+
+	writeHeader(w, "ultraftp_passive_listeners_active", "gauge", "Passive data listeners currently open.")
+	fmt.Fprintf(w, "ultraftp_passive_listeners_active %d\n", m.passiveActive)
+
+	writeHeader(w, "ultraftp_passive_listeners_total", "counter", "Passive data listeners opened.")
+	fmt.Fprintf(w, "ultraftp_passive_listeners_total %d\n", m.passiveTotal)
+
+	writeHeader(w, "ultraftp_passive_ports_exhausted_total", "counter", "Passive mode requests refused because no port in the range was free.")
+	fmt.Fprintf(w, "ultraftp_passive_ports_exhausted_total %d\n", m.passiveExhausted)
+
+	writeHeader(w, "ultraftp_events_total", "counter", "Event deliveries to hooks, by outcome.")
+	for _, status := range []string{"delivered", "failed", "dropped"} {
+		fmt.Fprintf(w, "ultraftp_events_total{status=%q} %d\n", status, m.events[status])
+	}
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// quoteLabel quotes a label value as the Prometheus text format expects
+func quoteLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return `"` + value + `"`
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Errors for operations the mount table can't perform
+var (
+	errMountPoint = errors.New("mount point or one of its parents")
+	errCrossMount = errors.New("cannot rename across mount points")
+)
+
+// Mount attaches a file system at a virtual path
+type Mount struct {
+	// Path is the virtual directory the file system appears as
+	Path string
+	// FileSystem provides the contents of the directory
+	FileSystem FileSystem
+}
+
+// ParseMount parses a mount of a local directory, given as
+// "/virtual/path=/local/dir" with an optional ":ro" or ":rw" suffix. Mounts
+// are writable unless marked read-only.
+func ParseMount(s string) (Mount, error) {
+	virtualPath, dir, ok := strings.Cut(s, "=")
+	if !ok || !strings.HasPrefix(virtualPath, "/") || dir == "" {
+		return Mount{}, fmt.Errorf("invalid mount %q, expected /path=directory[:ro|:rw]", s)
+	}
+
+	readOnly := false
+	if d, ok := strings.CutSuffix(dir, ":ro"); ok {
+		dir, readOnly = d, true
+	} else if d, ok := strings.CutSuffix(dir, ":rw"); ok {
+		dir = d
+	}
+
+	osfs, err := NewOSFileSystem(dir)
+	if err != nil {
+		return Mount{}, fmt.Errorf("mount %s: %w", virtualPath, err)
+	}
+
+	var fsys FileSystem = osfs
+	if readOnly {
+		fsys = ReadOnly(fsys)
+	}
+	return Mount{Path: path.Clean(virtualPath), FileSystem: fsys}, nil
+}
+
+// MountTable combines several file systems into one namespace. Each mount
+// serves the part of the namespace below its path, and the deepest mount
+// containing a path wins. Directories leading up to a mount point appear
+// as read-only directories even where no mount covers them.
+type MountTable struct {
+	// mounts are sorted by path, deepest first
+	mounts  []Mount
+	created time.Time
+}
+
+// NewMountTable returns a file system made of the given mounts. A mount at
+// "/" provides the root; without one the root only contains the mount
+// points.
+func NewMountTable(mounts []Mount) (*MountTable, error) {
+	table := &MountTable{created: time.Now()}
+	seen := make(map[string]bool)
+	for _, mount := range mounts {
+		if !strings.HasPrefix(mount.Path, "/") {
+			return nil, fmt.Errorf("mount path %q is not absolute", mount.Path)
+		}
+		if mount.FileSystem == nil {
+			return nil, fmt.Errorf("mount %s has no file system", mount.Path)
+		}
+		mount.Path = path.Clean(mount.Path)
+		if seen[mount.Path] {
+			return nil, fmt.Errorf("%s is mounted more than once", mount.Path)
+		}
+		seen[mount.Path] = true
+		table.mounts = append(table.mounts, mount)
+	}
+
+	sort.Slice(table.mounts, func(i, j int) bool {
+		return len(table.mounts[i].Path) > len(table.mounts[j].Path)
+	})
+	return table, nil
+}
+
+// find returns the mount serving a virtual path and the path within that
+// mount. ok is false if no mount covers the path.
+func (t *MountTable) find(name string) (mount Mount, rel string, ok bool) {
+	for _, mount := range t.mounts {
+		if isWithinVirtual(mount.Path, name) {
+			rel = "/" + strings.TrimPrefix(strings.TrimPrefix(name, mount.Path), "/")
+			return mount, rel, true
+		}
+	}
+	return Mount{}, "", false
+}
+
+// isMountPoint reports whether a path is a mount point or has one below it,
+// so that it can't be removed, renamed or replaced
+func (t *MountTable) isMountPoint(name string) bool {
+	for _, mount := range t.mounts {
+		if isWithinVirtual(name, mount.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// childMounts returns the names of the entries of a directory that lead to
+// mount points below it
+func (t *MountTable) childMounts(dir string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, mount := range t.mounts {
+		if mount.Path == dir || !isWithinVirtual(dir, mount.Path) {
+			continue
+		}
+		rest := strings.TrimPrefix(strings.TrimPrefix(mount.Path, dir), "/")
+		name, _, _ := strings.Cut(rest, "/")
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// virtualDir describes a directory that only exists because mount points
+// lie below it
+func (t *MountTable) virtualDir(name string) fs.FileInfo {
+	return &memFileInfo{name: path.Base(name), mode: fs.ModeDir | 0555, modTime: t.created}
+}
+
+func (t *MountTable) Stat(name string) (fs.FileInfo, error) {
+	mount, rel, ok := t.find(name)
+	if !ok {
+		if t.isMountPoint(name) {
+			return t.virtualDir(name), nil
+		}
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	info, err := mount.FileSystem.Stat(rel)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) && t.isMountPoint(name) {
+			return t.virtualDir(name), nil
+		}
+		return nil, err
+	}
+
+	// A mount's root is named after its mount point
+	if rel == "/" {
+		return &renamedFileInfo{FileInfo: info, name: path.Base(name)}, nil
+	}
+	return info, nil
+}
+
+func (t *MountTable) ReadDir(name string) ([]fs.FileInfo, error) {
+	var entries []fs.FileInfo
+	if mount, rel, ok := t.find(name); ok {
+		var err error
+		entries, err = mount.FileSystem.ReadDir(rel)
+		if err != nil && !(errors.Is(err, fs.ErrNotExist) && t.isMountPoint(name)) {
+			return nil, err
+		}
+	} else if !t.isMountPoint(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	// Mount points hide whatever is in their place
+	children := t.childMounts(name)
+	if len(children) == 0 {
+		return entries, nil
+	}
+	hidden := make(map[string]bool)
+	for _, child := range children {
+		hidden[child] = true
+	}
+	merged := make([]fs.FileInfo, 0, len(entries)+len(children))
+	for _, entry := range entries {
+		if !hidden[entry.Name()] {
+			merged = append(merged, entry)
+		}
+	}
+	for _, child := range children {
+		info, err := t.Stat(path.Join(name, child))
+		if err != nil {
+			continue
+		}
+		merged = append(merged, info)
+	}
+
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Name() < merged[j].Name() })
+	return merged, nil
+}
+
+func (t *MountTable) Open(name string) (File, error) {
+	return t.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (t *MountTable) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 && t.isMountPoint(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errMountPoint}
+	}
+	mount, rel, ok := t.find(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return mount.FileSystem.OpenFile(rel, flag, perm)
+}
+
+func (t *MountTable) Mkdir(name string, perm fs.FileMode) error {
+	if t.isMountPoint(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	mount, rel, ok := t.find(name)
+	if !ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+	}
+	return mount.FileSystem.Mkdir(rel, perm)
+}
+
+func (t *MountTable) Remove(name string) error {
+	if t.isMountPoint(name) {
+		return &fs.PathError{Op: "remove", Path: name, Err: errMountPoint}
+	}
+	mount, rel, ok := t.find(name)
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	return mount.FileSystem.Remove(rel)
+}
+
+func (t *MountTable) Rename(oldName, newName string) error {
+	if t.isMountPoint(oldName) || t.isMountPoint(newName) {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: errMountPoint}
+	}
+	oldMount, oldRel, ok := t.find(oldName)
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: fs.ErrNotExist}
+	}
+	newMount, newRel, ok := t.find(newName)
+	if !ok || newMount.Path != oldMount.Path {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: errCrossMount}
+	}
+	return oldMount.FileSystem.Rename(oldRel, newRel)
+}
+
+func (t *MountTable) AtomicCreate(name string) bool {
+	mount, rel, ok := t.find(name)
+	return ok && createsAtomically(mount.FileSystem, rel)
+}
+
+func (t *MountTable) IsReadOnly(name string) bool {
+	mount, rel, ok := t.find(name)
+	return ok && isReadOnly(mount.FileSystem, rel)
+}
+
+// Sub returns a file system rooted at dir. A directory inside a single
+// mount is handed to that mount, so it can confine the view itself.
+func (t *MountTable) Sub(dir string) (FileSystem, error) {
+	if mount, rel, ok := t.find(dir); ok && len(t.childMounts(dir)) == 0 {
+		return Sub(mount.FileSystem, rel)
+	}
+
+	info, err := t.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: errNotDir}
+	}
+	return &subFileSystem{fsys: t, dir: dir}, nil
+}
+
+// renamedFileInfo reports a different name for a file
+type renamedFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i *renamedFileInfo) Name() string { return i.name }
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks is how many symlinks may be followed while resolving a path
+const maxSymlinks = 255
+
+// errTooManyLinks is returned when resolving a path follows more than
+// maxSymlinks symlinks, as happens with loops
+var errTooManyLinks = errors.New("too many levels of symbolic links")
+
+// OSFileSystem serves a directory on the local disk. Symlinks are followed,
+// but never out of the directory.
+type OSFileSystem struct {
+	root string
+}
+
+// NewOSFileSystem returns a file system serving the directory root
+func NewOSFileSystem(root string) (*OSFileSystem, error) {
+	// Resolve the root directory to an absolute path
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid root directory: %w", err)
+	}
+
+	// Check if the directory exists
+	info, err := os.Stat(absRoot)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access root directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("root path is not a directory: %s", absRoot)
+	}
+
+	// Resolve symlinks in the root itself so path confinement checks
+	// compare like with like
+	absRoot, err = filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve root directory: %w", err)
+	}
+
+	return &OSFileSystem{root: absRoot}, nil
+}
+
+// Root returns the absolute, symlink free path of the served directory
+func (f *OSFileSystem) Root() string {
+	return f.root
+}
+
+// resolve maps a virtual path onto the local disk.
+//
+// Symlinks are followed and the result is rejected if it ends up outside
+// the root directory. The path does not have to exist; in that case its
+// nearest existing ancestor is checked instead, along with the target of a
+// dangling symlink on the way, which creating the path would follow.
+func (f *OSFileSystem) resolve(op, name string) (string, error) {
+	fullPath := filepath.Join(f.root, filepath.FromSlash(name))
+
+	realPath, err := evalExistingSymlinks(fullPath)
+	if err != nil {
+		return "", err
+	}
+	if !isWithin(f.root, realPath) {
+		return "", &fs.PathError{Op: op, Path: name, Err: errOutsideRoot}
+	}
+	return realPath, nil
+}
+
+// resolveLink maps a virtual path onto the local disk like resolve, but
+// leaves a symlink in its last component alone, for operations that act on
+// the link itself rather than on what it points to
+func (f *OSFileSystem) resolveLink(op, name string) (string, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	dir, err := f.resolve(op, path.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, path.Base(name)), nil
+}
+
+func (f *OSFileSystem) Stat(name string) (fs.FileInfo, error) {
+	fullPath, err := f.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(fullPath)
+}
+
+func (f *OSFileSystem) ReadDir(name string) ([]fs.FileInfo, error) {
+	fullPath, err := f.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		// Skip entries that vanished since the directory was read
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (f *OSFileSystem) Open(name string) (File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *OSFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	fullPath, err := f.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	// The resolved path contains no symlinks, so one appearing in its place
+	// since can only be an attempt to escape the root
+	file, err := os.OpenFile(fullPath, flag|openNoFollow, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *OSFileSystem) Mkdir(name string, perm fs.FileMode) error {
+	fullPath, err := f.resolve("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(fullPath, perm)
+}
+
+func (f *OSFileSystem) Remove(name string) error {
+	fullPath, err := f.resolveLink("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fullPath)
+}
+
+func (f *OSFileSystem) Rename(oldName, newName string) error {
+	oldPath, err := f.resolveLink("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := f.resolveLink("rename", newName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// Sub returns a file system serving a subdirectory. Symlinks in it are
+// confined to the subdirectory, not just to the parent's root.
+func (f *OSFileSystem) Sub(dir string) (FileSystem, error) {
+	fullPath, err := f.resolve("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	return NewOSFileSystem(fullPath)
+}
+
+// evalExistingSymlinks resolves symlinks in the longest existing prefix of
+// p and appends the remaining, not yet existing, components unchanged. A
+// dangling symlink is replaced by its target, so the result is where
+// creating p would actually create a file.
+func evalExistingSymlinks(p string) (string, error) {
+	var missing []string
+	current := p
+	links := 0
+	for {
+		resolved, err := filepath.EvalSymlinks(current)
+		if err == nil {
+			// Re-attach the components that don't exist yet
+			for i := len(missing) - 1; i >= 0; i-- {
+				resolved = filepath.Join(resolved, missing[i])
+			}
+			return resolved, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		// A dangling symlink: carry on from the path it points to
+		if info, err := os.Lstat(current); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			links++
+			if links > maxSymlinks {
+				return "", &fs.PathError{Op: "resolve", Path: p, Err: errTooManyLinks}
+			}
+			target, err := os.Readlink(current)
+			if err != nil {
+				return "", err
+			}
+			if !filepath.IsAbs(target) {
+				// The link's directory exists, or Lstat would have failed
+				dir, err := filepath.EvalSymlinks(filepath.Dir(current))
+				if err != nil {
+					return "", err
+				}
+				target = filepath.Join(dir, target)
+			}
+			current = target
+			continue
+		}
+
+		parent := filepath.Dir(current)
+		if parent == current {
+			return "", err
+		}
+		missing = append(missing, filepath.Base(current))
+		current = parent
+	}
+}
+
+// isWithin reports whether p is root or a path below it
+func isWithin(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package server
+
+// openNoFollow is not available on this platform; paths are still checked
+// for symlinks before they are opened
+const openNoFollow = 0
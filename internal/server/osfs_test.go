@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestOSFileSystem returns a file system serving a new directory, and a
+// second directory outside of it
+func newTestOSFileSystem(t *testing.T) (fsys *OSFileSystem, outside string) {
+	t.Helper()
+	fsys, err := NewOSFileSystem(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside, err = filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys, outside
+}
+
+// symlink creates a symlink, skipping the test where that isn't possible
+func symlink(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("cannot create symlinks: %v", err)
+	}
+}
+
+func TestOSFileSystemDanglingSymlinkOutsideRoot(t *testing.T) {
+	fsys, outside := newTestOSFileSystem(t)
+	pwned := filepath.Join(outside, "pwned")
+	symlink(t, pwned, filepath.Join(fsys.Root(), "evil"))
+	symlink(t, filepath.Join(outside, "missing"), filepath.Join(fsys.Root(), "evildir"))
+
+	for _, name := range []string{"/evil", "/evildir/file"} {
+		for _, flag := range []int{
+			os.O_WRONLY | os.O_CREATE,
+			os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+			os.O_WRONLY | os.O_CREATE | os.O_EXCL,
+		} {
+			file, err := fsys.OpenFile(name, flag, 0644)
+			if err == nil {
+				file.Close()
+				t.Errorf("OpenFile(%q, %#x) succeeded", name, flag)
+			} else if !errors.Is(err, errOutsideRoot) {
+				t.Errorf("OpenFile(%q, %#x) = %v, want %v", name, flag, err, errOutsideRoot)
+			}
+		}
+	}
+	if err := fsys.Mkdir("/evildir/sub", 0755); err == nil {
+		t.Error("Mkdir through a dangling symlink succeeded")
+	}
+
+	if _, err := os.Lstat(pwned); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file created outside the root: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("directory created outside the root: %v", err)
+	}
+}
+
+func TestOSFileSystemDanglingSymlinkInsideRoot(t *testing.T) {
+	fsys, _ := newTestOSFileSystem(t)
+	symlink(t, "new.txt", filepath.Join(fsys.Root(), "link"))
+
+	file, err := fsys.OpenFile("/link", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile through a symlink inside the root: %v", err)
+	}
+	file.Close()
+
+	if _, err := os.Stat(filepath.Join(fsys.Root(), "new.txt")); err != nil {
+		t.Errorf("link target not created: %v", err)
+	}
+}
+
+func TestOSFileSystemSymlinkLoop(t *testing.T) {
+	fsys, _ := newTestOSFileSystem(t)
+	symlink(t, "b", filepath.Join(fsys.Root(), "a"))
+	symlink(t, "a", filepath.Join(fsys.Root(), "b"))
+
+	if file, err := fsys.OpenFile("/a", os.O_WRONLY|os.O_CREATE, 0644); err == nil {
+		file.Close()
+		t.Error("OpenFile through a symlink loop succeeded")
+	}
+}
+
+func TestOSFileSystemRemoveSymlink(t *testing.T) {
+	fsys, _ := newTestOSFileSystem(t)
+	real := filepath.Join(fsys.Root(), "real")
+	if err := os.WriteFile(real, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, "real", filepath.Join(fsys.Root(), "link"))
+
+	if err := fsys.Remove("/link"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(fsys.Root(), "link")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("link still exists: %v", err)
+	}
+	if _, err := os.Stat(real); err != nil {
+		t.Errorf("link target removed: %v", err)
+	}
+}
+
+func TestOSFileSystemRenameSymlink(t *testing.T) {
+	fsys, _ := newTestOSFileSystem(t)
+	if err := os.Mkdir(filepath.Join(fsys.Root(), "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	real := filepath.Join(fsys.Root(), "dir", "real")
+	if err := os.WriteFile(real, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, "dir/real", filepath.Join(fsys.Root(), "link"))
+
+	if err := fsys.Rename("/link", "/moved"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	info, err := os.Lstat(filepath.Join(fsys.Root(), "moved"))
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("link not renamed: %v", err)
+	}
+	if _, err := os.Stat(real); err != nil {
+		t.Errorf("link target moved: %v", err)
+	}
+}
+
+func TestOSFileSystemRemoveRoot(t *testing.T) {
+	fsys, _ := newTestOSFileSystem(t)
+	if err := fsys.Remove("/"); err == nil {
+		t.Error("Remove(\"/\") succeeded")
+	}
+	if _, err := os.Stat(fsys.Root()); err != nil {
+		t.Errorf("root removed: %v", err)
+	}
+}
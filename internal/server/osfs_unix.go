@@ -0,0 +1,8 @@
+//go:build unix
+
+package server
+
+import "syscall"
+
+// openNoFollow makes opening a file fail if its last component is a symlink
+const openNoFollow = syscall.O_NOFOLLOW
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// errNoPassivePorts is returned when every port in the passive range is busy
+var errNoPassivePorts = errors.New("no free passive ports")
+
+// portAllocator hands out passive mode listeners from a fixed port range.
+//
+// Ports are tracked so that concurrent sessions never try to bind the same
+// port, and allocation starts after the most recently used port so a port
+// isn't reused immediately after it was released.
+type portAllocator struct {
+	min, max int
+
+	mu    sync.Mutex
+	inUse map[int]bool
+	next  int
+}
+
+// newPortAllocator creates an allocator for the ports min to max inclusive
+func newPortAllocator(min, max int) *portAllocator {
+	return &portAllocator{
+		min:   min,
+		max:   max,
+		inUse: make(map[int]bool),
+		next:  min,
+	}
+}
+
+// listen opens a listener on a free port in the range. The port is
+// released again when the listener is closed.
+func (a *portAllocator) listen() (net.Listener, error) {
+	size := a.max - a.min + 1
+	for i := 0; i < size; i++ {
+		port, ok := a.reserve()
+		if !ok {
+			break
+		}
+
+		listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err != nil {
+			// Something outside the server is using this port, try the next
+			a.release(port)
+			continue
+		}
+
+		return &allocatedListener{
+			TCPListener: listener.(*net.TCPListener),
+			release:     func() { a.release(port) },
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%w in range %d-%d", errNoPassivePorts, a.min, a.max)
+}
+
+// reserve marks the next unused port as in use
+func (a *portAllocator) reserve() (int, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	size := a.max - a.min + 1
+	for i := 0; i < size; i++ {
+		port := a.next
+		a.next++
+		if a.next > a.max {
+			a.next = a.min
+		}
+
+		if !a.inUse[port] {
+			a.inUse[port] = true
+			return port, true
+		}
+	}
+
+	return 0, false
+}
+
+// release marks a port as free again
+func (a *portAllocator) release(port int) {
+	a.mu.Lock()
+	delete(a.inUse, port)
+	a.mu.Unlock()
+}
+
+// allocatedListener returns its port to the allocator when closed
+type allocatedListener struct {
+	*net.TCPListener
+	release func()
+	once    sync.Once
+}
+
+// Close closes the listener and releases its port
+func (l *allocatedListener) Close() error {
+	err := l.TCPListener.Close()
+	l.once.Do(l.release)
+	return err
+}
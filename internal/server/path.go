@@ -0,0 +1,53 @@
+package server
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errOutsideRoot is returned when a path resolves outside the server root
+var errOutsideRoot = errors.New("path is outside the server root")
+
+// resolvePath maps a client supplied path to a virtual path in the
+// session's file system.
+//
+// Relative paths are resolved against the session's working directory. The
+// virtual path is always absolute and clean, so ".." can never climb above
+// "/". Anything beyond that, such as following symlinks, is up to the file
+// system.
+func (s *Session) resolvePath(param string) string {
+	if param == "" {
+		return s.workDir
+	}
+	if strings.HasPrefix(param, "/") {
+		return path.Clean(param)
+	}
+	return path.Join(s.workDir, param)
+}
+
+// userFileSystem returns the file system that becomes a user's virtual
+// root. Users without a home directory get the server's file system. A
+// relative home directory is taken relative to the server's root and may
+// not leave it; an absolute one is a directory on the local disk.
+func (s *FTPServer) userFileSystem(user *User) (FileSystem, error) {
+	var fsys FileSystem
+	var err error
+	switch {
+	case user.HomeDir == "":
+		fsys = s.fs
+	case filepath.IsAbs(user.HomeDir):
+		fsys, err = NewOSFileSystem(user.HomeDir)
+	default:
+		fsys, err = Sub(s.fs, filepath.ToSlash(user.HomeDir))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.readOnly {
+		fsys = ReadOnly(fsys)
+	}
+	return fsys, nil
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Permission is a set of operations a user may perform
+type Permission uint
+
+const (
+	// PermList allows listing directories and reading file metadata
+	PermList Permission = 1 << iota
+	// PermDownload allows retrieving files
+	PermDownload
+	// PermUpload allows creating new files
+	PermUpload
+	// PermOverwrite allows replacing, appending to or resuming existing files
+	PermOverwrite
+	// PermDelete allows deleting files and directories
+	PermDelete
+	// PermRename allows renaming files and directories
+	PermRename
+	// PermMkdir allows creating directories
+	PermMkdir
+
+	// PermNone allows nothing but logging in and changing directories
+	PermNone Permission = 0
+	// PermRead allows listing and downloading
+	PermRead = PermList | PermDownload
+	// PermAll allows everything
+	PermAll = PermList | PermDownload | PermUpload | PermOverwrite | PermDelete | PermRename | PermMkdir
+
+	// permWrite are the permissions that modify the file system
+	permWrite = PermUpload | PermOverwrite | PermDelete | PermRename | PermMkdir
+)
+
+// permissionNames maps the names used in users files to permissions
+var permissionNames = map[string]Permission{
+	"list":      PermList,
+	"download":  PermDownload,
+	"upload":    PermUpload,
+	"overwrite": PermOverwrite,
+	"delete":    PermDelete,
+	"rename":    PermRename,
+	"mkdir":     PermMkdir,
+	"read":      PermRead,
+	"all":       PermAll,
+	"none":      PermNone,
+}
+
+// ParsePermission parses a comma separated list of permission names, such
+// as "list,download,upload". The names "read", "all" and "none" stand for
+// the corresponding sets.
+func ParsePermission(s string) (Permission, error) {
+	var perm Permission
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		p, ok := permissionNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown permission %q", name)
+		}
+		perm |= p
+	}
+	return perm, nil
+}
+
+// PermissionRule grants a set of permissions within a directory subtree
+type PermissionRule struct {
+	// Path is the virtual directory the rule applies to, including its
+	// subdirectories
+	Path string
+	// Allow is what the user may do there
+	Allow Permission
+}
+
+// ParsePermissionRule parses a rule of the form "[/path:]permissions". A
+// rule without a path applies to the whole tree.
+func ParsePermissionRule(s string) (PermissionRule, error) {
+	rule := PermissionRule{Path: "/"}
+	perms := s
+	if strings.HasPrefix(s, "/") {
+		var ok bool
+		rule.Path, perms, ok = strings.Cut(s, ":")
+		if !ok {
+			return PermissionRule{}, fmt.Errorf("invalid permission rule %q, expected /path:permissions", s)
+		}
+		rule.Path = path.Clean(rule.Path)
+	}
+
+	var err error
+	rule.Allow, err = ParsePermission(perms)
+	if err != nil {
+		return PermissionRule{}, err
+	}
+	return rule, nil
+}
+
+// permissionSet decides what a session may do where
+type permissionSet struct {
+	rules []PermissionRule
+	mask  Permission
+}
+
+// newPermissionSet returns the permissions of a user. Users without rules
+// may do everything. mask limits the result, as used by read-only mode.
+func newPermissionSet(rules []PermissionRule, mask Permission) permissionSet {
+	if len(rules) == 0 {
+		rules = []PermissionRule{{Path: "/", Allow: PermAll}}
+	}
+	return permissionSet{rules: rules, mask: mask}
+}
+
+// at returns the permissions granted for a virtual path: those of the
+// rule for the deepest directory containing it
+func (p permissionSet) at(virtualPath string) Permission {
+	best := -1
+	var allow Permission
+	for _, rule := range p.rules {
+		if !isWithinVirtual(rule.Path, virtualPath) || len(rule.Path) <= best {
+			continue
+		}
+		best = len(rule.Path)
+		allow = rule.Allow
+	}
+	return allow & p.mask
+}
+
+// isWithinVirtual reports whether virtualPath is dir or inside it
+func isWithinVirtual(dir, virtualPath string) bool {
+	if dir == "/" || dir == virtualPath {
+		return true
+	}
+	return strings.HasPrefix(virtualPath, dir+"/")
+}
+
+// can reports whether the session may perform an operation on a path. If
+// not, it replies 550 to the client.
+func (s *Session) can(virtualPath string, perm Permission) bool {
+	if s.permissions.at(virtualPath)&perm == perm {
+		return true
+	}
+	s.log().Info("Permission denied", "path", virtualPath)
+	s.writeResponse(550, "Permission denied")
+	return false
+}
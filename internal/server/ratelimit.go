@@ -0,0 +1,79 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/titan/ultraftp/pkg/common"
+)
+
+// RateLimits configures bandwidth throttling in bytes per second. Zero means
+// unlimited.
+type RateLimits struct {
+	// Download limits data sent to clients (RETR)
+	Download int64
+	// Upload limits data received from clients (STOR, APPE)
+	Upload int64
+}
+
+// rateLimiters holds the token buckets for both directions
+type rateLimiters struct {
+	limits   RateLimits
+	download *common.RateLimiter
+	upload   *common.RateLimiter
+}
+
+// newRateLimiters returns token buckets for the given limits
+func newRateLimiters(limits RateLimits) *rateLimiters {
+	return &rateLimiters{
+		limits:   limits,
+		download: common.NewRateLimiter(limits.Download),
+		upload:   common.NewRateLimiter(limits.Upload),
+	}
+}
+
+// userRateLimiters hands out the buckets shared by all sessions of a user
+type userRateLimiters struct {
+	mu    sync.Mutex
+	users map[string]*rateLimiters
+}
+
+// get returns the shared buckets for a user, creating them on first use.
+// Users without limits of their own get nil.
+func (u *userRateLimiters) get(user *User) *rateLimiters {
+	if user == nil || (user.RateLimits == RateLimits{}) {
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.users == nil {
+		u.users = make(map[string]*rateLimiters)
+	}
+	// Replace the buckets if the limits changed since they were created
+	limiters := u.users[user.Name]
+	if limiters == nil || limiters.limits != user.RateLimits {
+		limiters = newRateLimiters(user.RateLimits)
+		u.users[user.Name] = limiters
+	}
+	return limiters
+}
+
+// downloadLimiters returns the limiters that apply to data sent to a session
+func (s *FTPServer) downloadLimiters(session *Session) []*common.RateLimiter {
+	limiters := []*common.RateLimiter{s.globalRate.download, session.rate.download}
+	if user := s.userRates.get(session.user); user != nil {
+		limiters = append(limiters, user.download)
+	}
+	return limiters
+}
+
+// uploadLimiters returns the limiters that apply to data received from a
+// session
+func (s *FTPServer) uploadLimiters(session *Session) []*common.RateLimiter {
+	limiters := []*common.RateLimiter{s.globalRate.upload, session.rate.upload}
+	if user := s.userRates.get(session.user); user != nil {
+		limiters = append(limiters, user.upload)
+	}
+	return limiters
+}
@@ -0,0 +1,471 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Credentials the fake S3 server accepts
+const (
+	fakeS3AccessKey = "AKIDEXAMPLE"
+	fakeS3SecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	fakeS3Bucket    = "bucket"
+	fakeS3Region    = "eu-test-1"
+)
+
+// fakeS3 is an in-process stand-in for the S3 API, covering what
+// S3FileSystem uses. It checks request signatures independently of the
+// client's signing code, pages listings and enforces the minimum part size
+// of multipart uploads, as S3 does.
+type fakeS3 struct {
+	t      *testing.T
+	server *httptest.Server
+
+	// pageSize caps the keys returned per ListObjectsV2 page, so that
+	// small test buckets need several pages
+	pageSize int
+
+	mu         sync.Mutex
+	objects    map[string]fakeS3Object
+	uploads    map[string]*fakeS3Upload
+	nextUpload int
+	// calls counts requests by operation, e.g. "ListObjectsV2"
+	calls map[string]int
+}
+
+type fakeS3Object struct {
+	data    []byte
+	modTime time.Time
+}
+
+type fakeS3Upload struct {
+	key   string
+	parts map[int][]byte
+}
+
+// newFakeS3 starts a fake S3 server, stopped when the test ends
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+	f := &fakeS3{
+		t:        t,
+		pageSize: 1000,
+		objects:  make(map[string]fakeS3Object),
+		uploads:  make(map[string]*fakeS3Upload),
+		calls:    make(map[string]int),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// config returns the configuration of a file system using the fake
+func (f *fakeS3) config() S3Config {
+	return S3Config{
+		Bucket:          fakeS3Bucket,
+		Endpoint:        f.server.URL,
+		Region:          fakeS3Region,
+		AccessKeyID:     fakeS3AccessKey,
+		SecretAccessKey: fakeS3SecretKey,
+		PathStyle:       true,
+		PartSize:        minS3PartSize,
+	}
+}
+
+// object returns the contents of an object
+func (f *fakeS3) object(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object, ok := f.objects[key]
+	return object.data, ok
+}
+
+// putObject stores an object directly
+func (f *fakeS3) putObject(key string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = fakeS3Object{data: data, modTime: time.Now()}
+}
+
+// count returns how many requests for an operation were made
+func (f *fakeS3) count(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// pendingUploads returns how many multipart uploads are neither completed
+// nor aborted
+func (f *fakeS3) pendingUploads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.uploads)
+}
+
+func (f *fakeS3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.fail(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if err := f.checkSignature(r, body); err != nil {
+		f.fail(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != fakeS3Bucket {
+		f.fail(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+	query := r.URL.Query()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		f.calls["ListObjectsV2"]++
+		f.list(w, query)
+	case r.Method == http.MethodHead:
+		f.calls["HeadObject"]++
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Header().Set("Last-Modified", object.modTime.UTC().Format(http.TimeFormat))
+	case r.Method == http.MethodGet:
+		f.calls["GetObject"]++
+		f.get(w, r, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		f.calls["UploadPart"]++
+		upload, ok := f.uploads[query.Get("uploadId")]
+		number, err := strconv.Atoi(query.Get("partNumber"))
+		if !ok || upload.key != key || err != nil {
+			f.fail(w, http.StatusNotFound, "NoSuchUpload", key)
+			return
+		}
+		upload.parts[number] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.calls["CopyObject"]++
+		source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		if err != nil {
+			f.fail(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+			return
+		}
+		object, ok := f.objects[strings.TrimPrefix(source, "/"+fakeS3Bucket+"/")]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey", source)
+			return
+		}
+		f.objects[key] = fakeS3Object{data: object.data, modTime: time.Now()}
+		fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", etag(object.data))
+	case r.Method == http.MethodPut:
+		f.calls["PutObject"]++
+		f.objects[key] = fakeS3Object{data: body, modTime: time.Now()}
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		f.calls["AbortMultipartUpload"]++
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		f.calls["DeleteObject"]++
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.calls["CreateMultipartUpload"]++
+		f.nextUpload++
+		uploadID := fmt.Sprintf("upload-%d", f.nextUpload)
+		f.uploads[uploadID] = &fakeS3Upload{key: key, parts: make(map[int][]byte)}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key, uploadID)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.calls["CompleteMultipartUpload"]++
+		f.complete(w, key, query.Get("uploadId"), body)
+	default:
+		f.fail(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.String())
+	}
+}
+
+// get serves an object, honouring "bytes=N-" ranges
+func (f *fakeS3) get(w http.ResponseWriter, r *http.Request, key string) {
+	object, ok := f.objects[key]
+	if !ok {
+		f.fail(w, http.StatusNotFound, "NoSuchKey", key)
+		return
+	}
+
+	data := object.data
+	status := http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		start, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rangeHeader, "bytes="), "-"))
+		if err != nil || start >= len(data) {
+			f.fail(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", rangeHeader)
+			return
+		}
+		data = data[start:]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// list serves a page of ListObjectsV2
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	token := query.Get("continuation-token")
+	maxKeys := f.pageSize
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n < maxKeys {
+		maxKeys = n
+	}
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		Size         int    `xml:"Size"`
+		ETag         string `xml:"ETag"`
+	}
+	type commonPrefix struct {
+		Prefix string `xml:"Prefix"`
+	}
+	var result struct {
+		XMLName               xml.Name       `xml:"ListBucketResult"`
+		Prefix                string         `xml:"Prefix"`
+		KeyCount              int            `xml:"KeyCount"`
+		IsTruncated           bool           `xml:"IsTruncated"`
+		NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+		Contents              []content      `xml:"Contents"`
+		CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+	}
+	result.Prefix = prefix
+
+	// The token is the last key or common prefix of the previous page
+	last := ""
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || (token != "" && key <= token) {
+			continue
+		}
+		if delimiter != "" && strings.HasSuffix(token, delimiter) && strings.HasPrefix(key, token) {
+			continue
+		}
+
+		item := key
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			item = key[:len(prefix)+i+len(delimiter)]
+			if item == last {
+				continue
+			}
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = last
+			break
+		}
+
+		if item == key {
+			object := f.objects[key]
+			result.Contents = append(result.Contents, content{
+				Key:          key,
+				LastModified: object.modTime.UTC().Format(time.RFC3339Nano),
+				Size:         len(object.data),
+				ETag:         etag(object.data),
+			})
+		} else {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: item})
+		}
+		result.KeyCount++
+		last = item
+	}
+
+	data, err := xml.Marshal(result)
+	if err != nil {
+		f.t.Errorf("fake S3: %v", err)
+	}
+	w.Write(data)
+}
+
+// complete assembles a multipart upload
+func (f *fakeS3) complete(w http.ResponseWriter, key, uploadID string, body []byte) {
+	upload, ok := f.uploads[uploadID]
+	if !ok || upload.key != key {
+		f.fail(w, http.StatusNotFound, "NoSuchUpload", uploadID)
+		return
+	}
+
+	var request struct {
+		Parts []s3Part `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil || len(request.Parts) == 0 {
+		f.fail(w, http.StatusBadRequest, "MalformedXML", string(body))
+		return
+	}
+
+	var data bytes.Buffer
+	for i, part := range request.Parts {
+		partData, ok := upload.parts[part.PartNumber]
+		if part.PartNumber != i+1 || !ok || part.ETag != etag(partData) {
+			f.fail(w, http.StatusBadRequest, "InvalidPart", strconv.Itoa(part.PartNumber))
+			return
+		}
+		if i < len(request.Parts)-1 && len(partData) < minS3PartSize {
+			f.fail(w, http.StatusBadRequest, "EntityTooSmall", strconv.Itoa(part.PartNumber))
+			return
+		}
+		data.Write(partData)
+	}
+
+	delete(f.uploads, uploadID)
+	f.objects[key] = fakeS3Object{data: data.Bytes(), modTime: time.Now()}
+	fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>", key, etag(data.Bytes()))
+}
+
+// fail sends an S3 error document
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, xmlEscape(message))
+}
+
+// checkSignature verifies a Signature Version 4 Authorization header the
+// way S3 does: by rebuilding the canonical request from what arrived on
+// the wire
+func (f *fakeS3) checkSignature(r *http.Request, body []byte) error {
+	credential, signedHeaders, signature, err := parseAuthorization(r.Header.Get("Authorization"))
+	if err != nil {
+		return err
+	}
+	scope := strings.Split(credential, "/")
+	if len(scope) != 5 || scope[0] != fakeS3AccessKey || scope[2] != fakeS3Region || scope[3] != "s3" || scope[4] != "aws4_request" {
+		return fmt.Errorf("bad credential %q", credential)
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if !strings.HasPrefix(amzDate, scope[1]) {
+		return fmt.Errorf("date %q doesn't match scope %q", amzDate, scope[1])
+	}
+
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	if r.Header.Get("X-Amz-Content-Sha256") != payloadHash {
+		return fmt.Errorf("payload hash mismatch")
+	}
+
+	// S3 escapes the decoded path itself, so a client escaping it
+	// differently fails here as it would there
+	segments := strings.Split(r.URL.Path, "/")
+	for i, segment := range segments {
+		segments[i] = queryEscape(segment)
+	}
+	var headers strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := strings.Join(r.Header.Values(name), ",")
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	if !strings.Contains(";"+signedHeaders+";", ";x-amz-content-sha256;") {
+		return fmt.Errorf("payload hash not signed")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		strings.Join(segments, "/"),
+		canonicalQuery(r.URL.Query()),
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + strings.Join(scope[1:], "/") + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+fakeS3SecretKey), scope[1])
+	for _, part := range scope[2:] {
+		key = hmacSHA256(key, part)
+	}
+	if want := hex.EncodeToString(hmacSHA256(key, stringToSign)); signature != want {
+		return fmt.Errorf("signature mismatch for canonical request:\n%s", canonicalRequest)
+	}
+	return nil
+}
+
+// parseAuthorization splits a Signature Version 4 Authorization header
+func parseAuthorization(header string) (credential, signedHeaders, signature string, err error) {
+	params, ok := strings.CutPrefix(header, "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return "", "", "", fmt.Errorf("unsigned request")
+	}
+	for _, param := range strings.Split(params, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch name {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			signature = value
+		}
+	}
+	if credential == "" || signedHeaders == "" || signature == "" {
+		return "", "", "", fmt.Errorf("malformed Authorization header %q", header)
+	}
+	return credential, signedHeaders, signature, nil
+}
+
+// canonicalQuery encodes a query as Signature Version 4 requires, using
+// the standard library's escaping rather than the client's
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, queryEscape(key)+"="+queryEscape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func queryEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// etag returns the quoted MD5 S3 uses as the ETag of simple objects
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,525 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultS3PartSize is the default for S3Config.PartSize
+const DefaultS3PartSize = 8 << 20
+
+// minS3PartSize is the smallest part S3 accepts, except for the last one
+const minS3PartSize = 5 << 20
+
+// S3Config configures an S3FileSystem
+type S3Config struct {
+	// Bucket is the bucket to serve
+	Bucket string
+	// Prefix is the key prefix that becomes the root directory. It may
+	// be empty to serve the whole bucket.
+	Prefix string
+	// Endpoint is the URL of the S3 API, e.g. http://localhost:9000 for a
+	// local S3-compatible server. Defaults to AWS in Region.
+	Endpoint string
+	// Region is the region requests are signed for. Defaults to us-east-1.
+	Region string
+	// AccessKeyID, SecretAccessKey and SessionToken are the credentials.
+	// Without an access key, requests are sent unsigned.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// PathStyle addresses the bucket in the path instead of the host
+	// name, as most S3-compatible servers require
+	PathStyle bool
+	// PartSize is the size of the parts of multipart uploads. Defaults to
+	// DefaultS3PartSize.
+	PartSize int64
+	// HTTPClient sends the requests. Defaults to a client without an
+	// overall timeout, so long transfers aren't cut off.
+	HTTPClient *http.Client
+}
+
+// ParseS3URL splits a URL of the form s3://bucket/prefix into the bucket
+// and the key prefix
+func ParseS3URL(rawURL string) (bucket, prefix string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid S3 URL %q: %w", rawURL, err)
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("invalid S3 URL %q, expected s3://bucket/prefix", rawURL)
+	}
+	return u.Host, strings.Trim(u.Path, "/"), nil
+}
+
+// S3FileSystem serves a bucket, or a prefix of one, through the S3 API.
+//
+// Keys are mapped onto paths by splitting them at slashes, so directories
+// are key prefixes. Mkdir creates an empty object named after the
+// directory with a trailing slash, as the S3 console does, so that empty
+// directories persist. Uploads are sent as multipart uploads. Appending to
+// objects, resuming uploads and renaming directories aren't possible.
+type S3FileSystem struct {
+	client   *s3Client
+	prefix   string
+	partSize int64
+}
+
+// NewS3FileSystem returns a file system serving a bucket
+func NewS3FileSystem(cfg S3Config) (*S3FileSystem, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("no S3 bucket given")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	endpoint.Path, endpoint.RawPath, endpoint.RawQuery = "", "", ""
+
+	if cfg.PartSize == 0 {
+		cfg.PartSize = DefaultS3PartSize
+	}
+	if cfg.PartSize < minS3PartSize {
+		return nil, fmt.Errorf("S3 part size must be at least %d bytes", minS3PartSize)
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{}
+	}
+
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &S3FileSystem{
+		client: &s3Client{
+			endpoint:  endpoint,
+			bucket:    cfg.Bucket,
+			region:    cfg.Region,
+			accessKey: cfg.AccessKeyID,
+			secretKey: cfg.SecretAccessKey,
+			token:     cfg.SessionToken,
+			pathStyle: cfg.PathStyle,
+			http:      cfg.HTTPClient,
+		},
+		prefix:   prefix,
+		partSize: cfg.PartSize,
+	}, nil
+}
+
+// key returns the object key of a file
+func (f *S3FileSystem) key(name string) string {
+	return f.prefix + strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// dirKey returns the key prefix of a directory's entries
+func (f *S3FileSystem) dirKey(name string) string {
+	key := f.key(name)
+	if key == "" || strings.HasSuffix(key, "/") {
+		return key
+	}
+	return key + "/"
+}
+
+// dirInfo describes a directory
+func dirInfo(name string, modTime time.Time) fs.FileInfo {
+	return &memFileInfo{name: path.Base(name), mode: fs.ModeDir | 0755, modTime: modTime}
+}
+
+// statDir reports whether a directory exists, which it does if any key
+// starts with its prefix
+func (f *S3FileSystem) statDir(name string) (fs.FileInfo, error) {
+	if path.Clean("/"+name) == "/" {
+		return dirInfo(name, time.Time{}), nil
+	}
+
+	result, err := f.client.list(f.dirKey(name), "", "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Contents) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return dirInfo(name, result.Contents[0].LastModified), nil
+}
+
+func (f *S3FileSystem) Stat(name string) (fs.FileInfo, error) {
+	if path.Clean("/"+name) == "/" {
+		return f.statDir(name)
+	}
+
+	size, modTime, err := f.client.head(f.key(name))
+	if err == nil {
+		return &memFileInfo{name: path.Base(name), size: size, mode: 0644, modTime: modTime}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return f.statDir(name)
+}
+
+func (f *S3FileSystem) ReadDir(name string) ([]fs.FileInfo, error) {
+	prefix := f.dirKey(name)
+	isRoot := path.Clean("/"+name) == "/"
+
+	var infos []fs.FileInfo
+	found := isRoot
+	token := ""
+	for {
+		result, err := f.client.list(prefix, "/", token, 0)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		for _, object := range result.Contents {
+			found = true
+			entry := strings.TrimPrefix(object.Key, prefix)
+			if entry == "" {
+				// The directory's own marker
+				continue
+			}
+			infos = append(infos, &memFileInfo{name: entry, size: object.Size, mode: 0644, modTime: object.LastModified})
+		}
+		for _, common := range result.CommonPrefixes {
+			found = true
+			entry := strings.TrimSuffix(strings.TrimPrefix(common.Prefix, prefix), "/")
+			if entry != "" {
+				infos = append(infos, dirInfo(entry, time.Time{}))
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	if !found {
+		// The name may be a file rather than a missing directory
+		if _, _, err := f.client.head(f.key(name)); err == nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (f *S3FileSystem) Open(name string) (File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *S3FileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		info, err := f.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		return &s3ReadFile{fsys: f, key: f.key(name), info: info}, nil
+	}
+
+	// Objects can only be replaced as a whole
+	if flag&(os.O_APPEND|os.O_RDWR) != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errS3Unsupported}
+	}
+	info, err := f.Stat(name)
+	switch {
+	case err == nil && info.IsDir():
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	case err == nil && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case err == nil && flag&os.O_TRUNC == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errS3Unsupported}
+	case err != nil && (!errors.Is(err, fs.ErrNotExist) || flag&os.O_CREATE == 0):
+		return nil, err
+	case err != nil:
+		if err := f.checkParent("open", name); err != nil {
+			return nil, err
+		}
+	}
+
+	return &s3WriteFile{fsys: f, key: f.key(name), name: name, modTime: time.Now()}, nil
+}
+
+// checkParent makes sure the directory a new entry goes into exists
+func (f *S3FileSystem) checkParent(op, name string) error {
+	info, err := f.Stat(path.Dir(path.Clean("/" + name)))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: errNotDir}
+	}
+	return nil
+}
+
+func (f *S3FileSystem) Mkdir(name string, perm fs.FileMode) error {
+	if _, err := f.Stat(name); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if err := f.checkParent("mkdir", name); err != nil {
+		return err
+	}
+	return f.client.put(f.dirKey(name), nil)
+}
+
+func (f *S3FileSystem) Remove(name string) error {
+	info, err := f.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return f.client.delete(f.key(name))
+	}
+	if path.Clean("/"+name) == "/" {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+
+	// Only the directory's marker may be left
+	prefix := f.dirKey(name)
+	result, err := f.client.list(prefix, "", "", 2)
+	if err != nil {
+		return err
+	}
+	for _, object := range result.Contents {
+		if object.Key != prefix {
+			return &fs.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+		}
+	}
+	return f.client.delete(prefix)
+}
+
+// AtomicCreate reports that new objects only appear once they are
+// complete, as PUT and CompleteMultipartUpload replace them in one step
+func (f *S3FileSystem) AtomicCreate(name string) bool {
+	return true
+}
+
+// Rename copies a file to its new key and deletes the old one. Renaming
+// directories would mean copying every object below them, so it isn't
+// supported.
+func (f *S3FileSystem) Rename(oldName, newName string) error {
+	info, err := f.Stat(oldName)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: errS3Unsupported}
+	}
+	if newInfo, err := f.Stat(newName); err == nil && newInfo.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: errors.New("is a directory")}
+	}
+	if err := f.checkParent("rename", newName); err != nil {
+		return err
+	}
+
+	if err := f.client.copy(f.key(oldName), f.key(newName)); err != nil {
+		return err
+	}
+	return f.client.delete(f.key(oldName))
+}
+
+// s3ReadFile streams an object, opening a ranged GET on the first read
+// after each seek
+type s3ReadFile struct {
+	fsys   *S3FileSystem
+	key    string
+	info   fs.FileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *s3ReadFile) Read(p []byte) (int, error) {
+	if f.info.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.key, Err: errors.New("is a directory")}
+	}
+	if f.body == nil {
+		if f.offset >= f.info.Size() {
+			return 0, io.EOF
+		}
+		body, err := f.fsys.client.get(f.key, f.offset)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3ReadFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.key, Err: fs.ErrInvalid}
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3ReadFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.key, Err: fs.ErrPermission}
+}
+
+func (f *s3ReadFile) Truncate(size int64) error {
+	return &fs.PathError{Op: "truncate", Path: f.key, Err: fs.ErrPermission}
+}
+
+func (f *s3ReadFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *s3ReadFile) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
+
+// s3WriteFile uploads an object. Data is buffered until a part is full;
+// small objects are sent with a single PUT when the file is closed.
+type s3WriteFile struct {
+	fsys     *S3FileSystem
+	key      string
+	name     string
+	modTime  time.Time
+	buf      bytes.Buffer
+	size     int64
+	uploadID string
+	parts    []s3Part
+	err      error
+	closed   bool
+}
+
+func (f *s3WriteFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+
+	f.buf.Write(p)
+	f.size += int64(len(p))
+	for int64(f.buf.Len()) >= f.fsys.partSize {
+		if err := f.uploadPart(f.buf.Next(int(f.fsys.partSize))); err != nil {
+			f.err = err
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// uploadPart sends the next part, starting the multipart upload first if
+// this is the first one
+func (f *s3WriteFile) uploadPart(data []byte) error {
+	if f.uploadID == "" {
+		uploadID, err := f.fsys.client.createMultipartUpload(f.key)
+		if err != nil {
+			return err
+		}
+		f.uploadID = uploadID
+	}
+
+	part, err := f.fsys.client.uploadPart(f.key, f.uploadID, len(f.parts)+1, data)
+	if err != nil {
+		return err
+	}
+	f.parts = append(f.parts, part)
+	return nil
+}
+
+// Seek only supports finding the current position, as the data written so
+// far may already have been uploaded
+func (f *s3WriteFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent, io.SeekEnd:
+		offset += f.size
+	}
+	if offset != f.size {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errS3Unsupported}
+	}
+	return offset, nil
+}
+
+func (f *s3WriteFile) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrPermission}
+}
+
+func (f *s3WriteFile) Truncate(size int64) error {
+	if size != f.size {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: errS3Unsupported}
+	}
+	return nil
+}
+
+func (f *s3WriteFile) Stat() (fs.FileInfo, error) {
+	return &memFileInfo{name: path.Base(f.name), size: f.size, mode: 0644, modTime: f.modTime}, nil
+}
+
+// Close finishes the upload. If writing failed, the multipart upload is
+// aborted and the object is left as it was.
+func (f *s3WriteFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+
+	if f.err == nil {
+		if f.uploadID == "" {
+			f.err = f.fsys.client.put(f.key, f.buf.Bytes())
+		} else {
+			if f.buf.Len() > 0 {
+				f.err = f.uploadPart(f.buf.Bytes())
+			}
+			if f.err == nil {
+				f.err = f.fsys.client.completeMultipartUpload(f.key, f.uploadID, f.parts)
+			}
+		}
+	}
+
+	if f.err != nil && f.uploadID != "" {
+		f.fsys.client.abortMultipartUpload(f.key, f.uploadID)
+	}
+	return f.err
+}
+
+// Abort gives up on the upload, leaving the object as it was
+func (f *s3WriteFile) Abort() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	f.buf.Reset()
+
+	if f.uploadID == "" {
+		return nil
+	}
+	return f.fsys.client.abortMultipartUpload(f.key, f.uploadID)
+}
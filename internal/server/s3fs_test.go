@@ -0,0 +1,334 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+// newTestS3FileSystem returns a file system serving the prefix "root" of a
+// fake S3 bucket
+func newTestS3FileSystem(t *testing.T) (*S3FileSystem, *fakeS3) {
+	t.Helper()
+	fake := newFakeS3(t)
+	cfg := fake.config()
+	cfg.Prefix = "/root/"
+	fsys, err := NewS3FileSystem(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys, fake
+}
+
+// writeFile creates a file on a file system with the given contents
+func writeFile(t *testing.T, fsys FileSystem, name string, data []byte) {
+	t.Helper()
+	file, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile(%q): %v", name, err)
+	}
+	if _, err := file.Write(data); err != nil {
+		t.Fatalf("Write(%q): %v", name, err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close(%q): %v", name, err)
+	}
+}
+
+// readFile returns the contents of a file on a file system
+func readFile(t *testing.T, fsys FileSystem, name string) []byte {
+	t.Helper()
+	file, err := fsys.Open(name)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", name, err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("reading %q: %v", name, err)
+	}
+	return data
+}
+
+// dirNames lists a directory, marking subdirectories with a slash
+func dirNames(t *testing.T, fsys FileSystem, name string) []string {
+	t.Helper()
+	entries, err := fsys.ReadDir(name)
+	if err != nil {
+		t.Fatalf("ReadDir(%q): %v", name, err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name()+"/")
+		} else {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func TestS3FileSystemReadWrite(t *testing.T) {
+	fsys, fake := newTestS3FileSystem(t)
+	name := "/a b+c&ü.txt"
+	writeFile(t, fsys, name, []byte("hello, world"))
+
+	if data, ok := fake.object("root/a b+c&ü.txt"); !ok || string(data) != "hello, world" {
+		t.Fatalf("object = %q, %v", data, ok)
+	}
+	if fake.count("CreateMultipartUpload") != 0 {
+		t.Error("small file sent as a multipart upload")
+	}
+
+	info, err := fsys.Stat(name)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Name() != "a b+c&ü.txt" || info.Size() != 12 || info.IsDir() {
+		t.Errorf("Stat = %q, %d bytes, dir %v", info.Name(), info.Size(), info.IsDir())
+	}
+	if got := readFile(t, fsys, name); string(got) != "hello, world" {
+		t.Errorf("read %q", got)
+	}
+
+	// Reading after a seek fetches a range
+	file, err := fsys.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(7, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(file); err != nil || string(data) != "world" {
+		t.Errorf("read after seek = %q, %v", data, err)
+	}
+
+	if _, err := fsys.Stat("/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of a missing file = %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestS3FileSystemOpenFileFlags(t *testing.T) {
+	fsys, _ := newTestS3FileSystem(t)
+	writeFile(t, fsys, "/file", []byte("data"))
+
+	tests := []struct {
+		name string
+		flag int
+		err  error
+	}{
+		{"/file", os.O_WRONLY | os.O_CREATE | os.O_EXCL, fs.ErrExist},
+		{"/file", os.O_WRONLY | os.O_APPEND, errS3Unsupported},
+		{"/file", os.O_WRONLY, errS3Unsupported},
+		{"/missing", os.O_WRONLY, fs.ErrNotExist},
+		{"/nodir/file", os.O_WRONLY | os.O_CREATE, fs.ErrNotExist},
+	}
+	for _, tt := range tests {
+		if file, err := fsys.OpenFile(tt.name, tt.flag, 0644); !errors.Is(err, tt.err) {
+			if err == nil {
+				file.Close()
+			}
+			t.Errorf("OpenFile(%q, %#x) = %v, want %v", tt.name, tt.flag, err, tt.err)
+		}
+	}
+}
+
+func TestS3FileSystemMultipartUpload(t *testing.T) {
+	fsys, fake := newTestS3FileSystem(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), (2*minS3PartSize+1000)/16)
+
+	file, err := fsys.OpenFile("/big", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write in odd sized chunks, as a transfer would
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 100_000)
+		if _, err := file.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if got := fake.count("UploadPart"); got != 3 {
+		t.Errorf("uploaded %d parts, want 3", got)
+	}
+	if fake.pendingUploads() != 0 {
+		t.Error("multipart upload not completed")
+	}
+	if got, _ := fake.object("root/big"); !bytes.Equal(got, data) {
+		t.Errorf("object has %d bytes, want %d", len(got), len(data))
+	}
+	if got := readFile(t, fsys, "/big"); !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestS3FileSystemAbort(t *testing.T) {
+	fsys, fake := newTestS3FileSystem(t)
+	writeFile(t, fsys, "/small", []byte("old"))
+	writeFile(t, fsys, "/big", []byte("old"))
+
+	for _, tt := range []struct {
+		name string
+		size int
+	}{
+		{"/small", 100},
+		{"/big", minS3PartSize + 100},
+	} {
+		file, err := fsys.OpenFile(tt.name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write(make([]byte, tt.size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := abortFile(file); err != nil {
+			t.Errorf("aborting %s: %v", tt.name, err)
+		}
+		// The deferred close of an aborted upload stores nothing either
+		if err := file.Close(); !errors.Is(err, fs.ErrClosed) {
+			t.Errorf("Close after Abort = %v, want %v", err, fs.ErrClosed)
+		}
+
+		if got := readFile(t, fsys, tt.name); string(got) != "old" {
+			t.Errorf("%s replaced by an aborted upload with %d bytes", tt.name, len(got))
+		}
+	}
+
+	if fake.count("CreateMultipartUpload") != 1 {
+		t.Errorf("started %d multipart uploads, want 1", fake.count("CreateMultipartUpload"))
+	}
+	if fake.pendingUploads() != 0 {
+		t.Error("aborted multipart upload left behind")
+	}
+}
+
+func TestS3FileSystemReadDir(t *testing.T) {
+	fsys, fake := newTestS3FileSystem(t)
+	fake.pageSize = 2
+
+	for _, name := range []string{"/b.txt", "/a.txt", "/dir one/x", "/dir one/y", "/dir2/z", "/c d.txt"} {
+		fake.putObject("root"+name, []byte(name))
+	}
+	fake.putObject("root/empty/", nil)
+	fake.putObject("outside", nil)
+
+	want := []string{"a.txt", "b.txt", "c d.txt", "dir one/", "dir2/", "empty/"}
+	if got := dirNames(t, fsys, "/"); !equalStrings(got, want) {
+		t.Errorf("ReadDir(/) = %q, want %q", got, want)
+	}
+	if fake.count("ListObjectsV2") < 3 {
+		t.Errorf("listing took %d pages, expected several", fake.count("ListObjectsV2"))
+	}
+
+	if got := dirNames(t, fsys, "/dir one"); !equalStrings(got, []string{"x", "y"}) {
+		t.Errorf("ReadDir(/dir one) = %q", got)
+	}
+	if got := dirNames(t, fsys, "/empty"); len(got) != 0 {
+		t.Errorf("ReadDir(/empty) = %q", got)
+	}
+	if _, err := fsys.ReadDir("/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadDir of a missing directory = %v, want %v", err, fs.ErrNotExist)
+	}
+	if _, err := fsys.ReadDir("/a.txt"); !errors.Is(err, errNotDir) {
+		t.Errorf("ReadDir of a file = %v, want %v", err, errNotDir)
+	}
+
+	info, err := fsys.Stat("/dir one")
+	if err != nil || !info.IsDir() {
+		t.Errorf("Stat of a directory = %v, %v", info, err)
+	}
+}
+
+func TestS3FileSystemMkdirRemove(t *testing.T) {
+	fsys, fake := newTestS3FileSystem(t)
+
+	if err := fsys.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if _, ok := fake.object("root/dir/"); !ok {
+		t.Error("no directory marker created")
+	}
+	if err := fsys.Mkdir("/dir", 0755); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Mkdir of an existing directory = %v, want %v", err, fs.ErrExist)
+	}
+	if err := fsys.Mkdir("/missing/dir", 0755); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Mkdir in a missing directory = %v, want %v", err, fs.ErrNotExist)
+	}
+
+	writeFile(t, fsys, "/dir/file", []byte("data"))
+	if err := fsys.Remove("/dir"); !errors.Is(err, errNotEmpty) {
+		t.Errorf("Remove of a non-empty directory = %v, want %v", err, errNotEmpty)
+	}
+	if err := fsys.Remove("/dir/file"); err != nil {
+		t.Fatalf("Remove of a file: %v", err)
+	}
+	if err := fsys.Remove("/dir"); err != nil {
+		t.Fatalf("Remove of an empty directory: %v", err)
+	}
+	if _, err := fsys.Stat("/dir"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of a removed directory = %v, want %v", err, fs.ErrNotExist)
+	}
+	if err := fsys.Remove("/"); err == nil {
+		t.Error("Remove of the root succeeded")
+	}
+}
+
+func TestS3FileSystemRename(t *testing.T) {
+	fsys, fake := newTestS3FileSystem(t)
+	writeFile(t, fsys, "/old name", []byte("data"))
+	if err := fsys.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fsys.Rename("/old name", "/dir/new&name"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, ok := fake.object("root/old name"); ok {
+		t.Error("old object still exists")
+	}
+	if got := readFile(t, fsys, "/dir/new&name"); string(got) != "data" {
+		t.Errorf("renamed file contains %q", got)
+	}
+
+	if err := fsys.Rename("/dir", "/dir2"); !errors.Is(err, errS3Unsupported) {
+		t.Errorf("Rename of a directory = %v, want %v", err, errS3Unsupported)
+	}
+	if err := fsys.Rename("/missing", "/x"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Rename of a missing file = %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestS3FileSystemBadCredentials(t *testing.T) {
+	fake := newFakeS3(t)
+	cfg := fake.config()
+	cfg.SecretAccessKey = "wrong"
+	fsys, err := NewS3FileSystem(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fsys.ReadDir("/"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("ReadDir with a wrong secret key = %v, want %v", err, fs.ErrPermission)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
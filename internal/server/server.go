@@ -2,119 +2,585 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
 	"net"
 	"os"
-	"path/filepath"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
+
+	"github.com/titan/ultraftp/pkg/common"
+)
+
+// Options configures an FTP server
+type Options struct {
+	// Port is the TCP port to listen on
+	Port int
+	// RootDir is the directory served to clients. It is ignored if
+	// FileSystem is set.
+	RootDir string
+	// FileSystem serves the files. If nil, RootDir on the local disk is
+	// served.
+	FileSystem FileSystem
+	// Mounts attach further file systems below the root. With mounts, an
+	// empty RootDir and nil FileSystem leave the root with nothing but
+	// the mount points.
+	Mounts []Mount
+	// Authenticator verifies user credentials. If nil, only anonymous
+	// logins are possible, and only when AllowAnonymous is set.
+	Authenticator Authenticator
+	// AllowAnonymous accepts the "anonymous" and "ftp" users with any password
+	AllowAnonymous bool
+	// AnonymousPermissions are what anonymous users may do. If empty, they
+	// may only list and download.
+	AnonymousPermissions []PermissionRule
+	// DataTimeout is how long to wait for a data connection to be
+	// established. Defaults to DefaultDataTimeout.
+	DataTimeout time.Duration
+	// PassivePortMin and PassivePortMax limit the ports used for passive
+	// data connections. If both are zero any free port is used.
+	PassivePortMin int
+	PassivePortMax int
+	// PublicHost is the IP address or hostname advertised in PASV replies.
+	// If empty, the local address of the control connection is used.
+	PublicHost string
+	// TLSConfig enables explicit FTPS (AUTH TLS) when set
+	TLSConfig *tls.Config
+	// RequireTLS rejects USER until the control connection is secured
+	// with AUTH TLS
+	RequireTLS bool
+	// Logger receives the server's log records. Defaults to slog.Default().
+	Logger *slog.Logger
+	// TransferLog, if set, receives a line in xferlog format for every
+	// file transfer
+	TransferLog io.Writer
+	// GlobalRateLimits throttles the combined transfers of all sessions
+	GlobalRateLimits RateLimits
+	// SessionRateLimits throttles the transfers of each session
+	SessionRateLimits RateLimits
+	// MaxSessions limits the number of concurrent sessions. Zero means
+	// unlimited.
+	MaxSessions int
+	// MaxSessionsPerIP limits the number of concurrent sessions from a
+	// single client address. Zero means unlimited.
+	MaxSessionsPerIP int
+	// IdleTimeout closes control connections that send no command for
+	// this long. Zero means no timeout.
+	IdleTimeout time.Duration
+	// StallTimeout aborts transfers when no data moves on the data
+	// connection for this long. Zero means no timeout.
+	StallTimeout time.Duration
+	// LoginFailureDelay is how long to wait before rejecting a failed
+	// login. It doubles with each further failure from the same address
+	// or for the same user, up to 10 seconds. Zero means no delay.
+	LoginFailureDelay time.Duration
+	// MaxLoginFailures bans an address after this many failed logins in a
+	// row. Zero disables bans.
+	MaxLoginFailures int
+	// BanDuration is how long an address stays banned
+	BanDuration time.Duration
+	// IPFilter restricts which addresses may connect, and which addresses
+	// PORT and EPRT may open data connections to
+	IPFilter IPFilter
+	// ReadOnly denies every command that would modify files, whatever the
+	// users' permissions
+	ReadOnly bool
+	// EventSinks receive events such as logins and completed uploads.
+	// Events are delivered in the background and never hold up clients.
+	EventSinks []EventSink
+	// EventTypes limits the events sent to the sinks. If empty, all
+	// events are sent.
+	EventTypes []EventType
+	// EventQueueSize is how many events may wait for each sink before new
+	// ones are dropped. Defaults to DefaultEventQueueSize.
+	EventQueueSize int
+	// EventRetries is how often a failed delivery is retried, with
+	// exponential backoff starting at one second
+	EventRetries int
+	// EventTimeout limits each delivery attempt. Defaults to
+	// DefaultEventTimeout.
+	EventTimeout time.Duration
+}
+
+// DefaultDataTimeout is the default for Options.DataTimeout
+const DefaultDataTimeout = 30 * time.Second
+
+// ErrServerClosed is returned by Serve and ListenAndServe after the server
+// has been shut down
+var ErrServerClosed = errors.New("ftp: server closed")
+
+// Errors for connections turned away at accept time
+var (
+	errTooManySessions = errors.New("too many sessions")
+	errTooManyFromIP   = errors.New("too many sessions from this address")
 )
 
 // FTPServer represents an FTP server instance
 type FTPServer struct {
-	Port       int
-	RootDir    string
-	listener   net.Listener
-	sessions   map[string]*Session
-	sessionsMu sync.Mutex
+	Port        int
+	RootDir     string
+	fs          FileSystem
+	auth        Authenticator
+	dataTimeout time.Duration
+	ports       *portAllocator
+	publicHost  string
+	tlsConfig   *tls.Config
+	requireTLS  bool
+	logger      *slog.Logger
+	xferlog     *transferLog
+	metrics     *metrics
+	globalRate  *rateLimiters
+	sessionRate RateLimits
+	userRates   userRateLimiters
+	maxSessions int
+	maxPerIP    int
+	idleTimeout time.Duration
+	stall       time.Duration
+	guard       *loginGuard
+	ipFilter    IPFilter
+	permMask    Permission
+	readOnly    bool
+	events      *eventDispatcher
+	listener    net.Listener
+	sessions    map[string]*Session
+	ipSessions  map[string]int
+	sessionsMu  sync.Mutex
+	sessionsWg  sync.WaitGroup
+	closing     bool
 }
 
 // Session represents a client session
 type Session struct {
+	id            string
+	logger        *slog.Logger
+	netConn       net.Conn
 	conn          net.Conn
 	controlReader *bufio.Reader
 	controlWriter *bufio.Writer
-	dataConn      net.Conn
+	data          *dataChannel
+	fs            FileSystem
 	workDir       string
+	pendingUser   string
+	renameFrom    string
+	uploads       map[string]bool
+	restOffset    int64
+	mlstSelected  []string
+	epsvAll       bool
+	tlsEnabled    bool
+	pbszSet       bool
+	protPrivate   bool
+	user          *User
+	permissions   permissionSet
 	authenticated bool
+	lastReply     int
+	rate          *rateLimiters
+
+	// stateMu guards busy and closed, which coordinate shutdown with the
+	// session's own goroutine
+	stateMu sync.Mutex
+	busy    bool
+	closed  bool
 }
 
-// Start initializes and starts the FTP server
-func Start(port int, rootDir string) error {
-	// Resolve the root directory to an absolute path
-	absRootDir, err := filepath.Abs(rootDir)
-	if err != nil {
-		return fmt.Errorf("invalid root directory: %w", err)
+// New creates an FTP server from the given options. The server doesn't
+// accept connections until Listen, Serve or ListenAndServe is called.
+func New(opts Options) (*FTPServer, error) {
+	// Serve the root directory unless another file system was given
+	fsys := opts.FileSystem
+	rootDir := ""
+	if fsys == nil && (opts.RootDir != "" || len(opts.Mounts) == 0) {
+		osfs, err := NewOSFileSystem(opts.RootDir)
+		if err != nil {
+			return nil, err
+		}
+		fsys = osfs
+		rootDir = osfs.Root()
 	}
 
-	// Check if the directory exists
-	info, err := os.Stat(absRootDir)
-	if err != nil {
-		return fmt.Errorf("cannot access root directory: %w", err)
+	// Combine the root with any mounts into one namespace
+	if len(opts.Mounts) > 0 {
+		mounts := opts.Mounts
+		if fsys != nil {
+			mounts = append([]Mount{{Path: "/", FileSystem: fsys}}, mounts...)
+		}
+		table, err := NewMountTable(mounts)
+		if err != nil {
+			return nil, err
+		}
+		fsys = table
+	}
+
+	// Wrap the authenticator to accept anonymous logins if requested
+	auth := opts.Authenticator
+	if opts.AllowAnonymous {
+		auth = &AnonymousAuthenticator{Next: auth, Permissions: opts.AnonymousPermissions}
+	}
+	if auth == nil {
+		return nil, fmt.Errorf("no authenticator configured and anonymous access is disabled")
+	}
+
+	if opts.MaxSessions < 0 || opts.MaxSessionsPerIP < 0 {
+		return nil, fmt.Errorf("session limits must not be negative")
+	}
+
+	if opts.MaxLoginFailures > 0 && opts.BanDuration <= 0 {
+		return nil, fmt.Errorf("a ban duration is required when MaxLoginFailures is set")
+	}
+
+	if opts.DataTimeout <= 0 {
+		opts.DataTimeout = DefaultDataTimeout
 	}
-	if !info.IsDir() {
-		return fmt.Errorf("root path is not a directory: %s", absRootDir)
+
+	// Validate the passive port range
+	if opts.PassivePortMin != 0 || opts.PassivePortMax != 0 {
+		if opts.PassivePortMin <= 0 || opts.PassivePortMax > 65535 || opts.PassivePortMin > opts.PassivePortMax {
+			return nil, fmt.Errorf("invalid passive port range: %d-%d", opts.PassivePortMin, opts.PassivePortMax)
+		}
+	}
+
+	if opts.RequireTLS && opts.TLSConfig == nil {
+		return nil, fmt.Errorf("TLS is required but no TLS configuration was given")
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
 	}
 
 	// Create and initialize the server
 	server := &FTPServer{
-		Port:     port,
-		RootDir:  absRootDir,
-		sessions: make(map[string]*Session),
+		Port:        opts.Port,
+		RootDir:     rootDir,
+		fs:          fsys,
+		auth:        auth,
+		dataTimeout: opts.DataTimeout,
+		publicHost:  opts.PublicHost,
+		tlsConfig:   opts.TLSConfig,
+		requireTLS:  opts.RequireTLS,
+		logger:      opts.Logger,
+		metrics:     newMetrics(),
+		globalRate:  newRateLimiters(opts.GlobalRateLimits),
+		sessionRate: opts.SessionRateLimits,
+		maxSessions: opts.MaxSessions,
+		maxPerIP:    opts.MaxSessionsPerIP,
+		idleTimeout: opts.IdleTimeout,
+		stall:       opts.StallTimeout,
+		ipFilter:    opts.IPFilter,
+		permMask:    PermAll,
+		guard:       newLoginGuard(opts.LoginFailureDelay, opts.MaxLoginFailures, opts.BanDuration),
+		sessions:    make(map[string]*Session),
+		ipSessions:  make(map[string]int),
+	}
+
+	if opts.ReadOnly {
+		server.permMask = PermAll &^ permWrite
+		server.readOnly = true
+	}
+
+	if opts.TransferLog != nil {
+		server.xferlog = &transferLog{w: opts.TransferLog}
+	}
+
+	if len(opts.EventSinks) > 0 {
+		server.events = newEventDispatcher(opts.EventSinks, opts.EventTypes, opts.EventQueueSize,
+			opts.EventRetries, opts.EventTimeout, opts.Logger, server.metrics)
+	}
+
+	if opts.PassivePortMin != 0 {
+		server.ports = newPortAllocator(opts.PassivePortMin, opts.PassivePortMax)
 	}
 
-	// Start listening for connections
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	return server, nil
+}
+
+// Start initializes and starts the FTP server, blocking until it fails
+func Start(opts Options) error {
+	server, err := New(opts)
 	if err != nil {
-		return fmt.Errorf("failed to listen on port %d: %w", port, err)
+		return err
+	}
+	return server.ListenAndServe()
+}
+
+// Listen binds the server's port without accepting connections yet, so
+// that Addr can report the address before Serve is called. Port 0 picks a
+// free port.
+func (s *FTPServer) Listen() error {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if s.closing {
+		return ErrServerClosed
+	}
+	if s.listener != nil {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Port))
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", s.Port, err)
+	}
+	s.listener = listener
+	return nil
+}
+
+// Addr returns the address the server is listening on, or nil if it isn't
+// listening
+func (s *FTPServer) Addr() net.Addr {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// ListenAndServe listens on the configured port and serves clients until
+// the server is shut down
+func (s *FTPServer) ListenAndServe() error {
+	return s.Serve(context.Background())
+}
+
+// Serve accepts and handles client connections, listening first if Listen
+// hasn't been called. It returns ErrServerClosed once Shutdown is called.
+// Cancelling ctx shuts the server down immediately, without waiting for
+// transfers in progress.
+func (s *FTPServer) Serve(ctx context.Context) error {
+	if err := s.Listen(); err != nil {
+		return err
 	}
-	server.listener = listener
 
-	fmt.Printf("FTP Server listening on port %d, serving directory: %s\n", port, absRootDir)
+	s.sessionsMu.Lock()
+	listener := s.listener
+	s.sessionsMu.Unlock()
+
+	s.logger.Info("FTP server listening", "addr", listener.Addr().String(), "root", s.RootDir)
+
+	// Clean up after uploads interrupted by an earlier run
+	go s.removeStaleUploads(time.Now())
+
+	// Stop when the context is cancelled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			expired, cancel := context.WithCancel(context.Background())
+			cancel()
+			s.Shutdown(expired)
+		case <-stop:
+		}
+	}()
 
 	// Accept and handle client connections
+	var backoff time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Printf("Error accepting connection: %v\n", err)
+			if s.isClosing() {
+				return ErrServerClosed
+			}
+
+			// Retry temporary errors such as running out of file
+			// descriptors, backing off so we don't spin
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff < time.Second {
+					backoff *= 2
+				}
+				s.logger.Warn("Error accepting connection", "error", err, "retry_in", backoff)
+				time.Sleep(backoff)
+				continue
+			}
+
+			return fmt.Errorf("error accepting connection: %w", err)
+		}
+		backoff = 0
+
+		// Register the session before handing it off so Shutdown sees it
+		session, err := s.newSession(conn)
+		if errors.Is(err, ErrServerClosed) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		if err != nil {
+			// Turn the client away without holding up the accept loop
+			go s.reject(conn, err)
 			continue
 		}
 
 		// Handle each client in a separate goroutine
-		go server.handleClient(conn)
+		go s.handleClient(session)
 	}
 }
 
-// handleClient processes a client connection
-func (s *FTPServer) handleClient(conn net.Conn) {
-	defer conn.Close()
+// Shutdown stops the server gracefully. It stops accepting connections,
+// closes idle sessions, and waits for sessions that are in the middle of
+// a command, such as a transfer, to finish it. Once ctx is done any
+// remaining sessions are closed forcibly and ctx's error is returned.
+func (s *FTPServer) Shutdown(ctx context.Context) error {
+	s.sessionsMu.Lock()
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.sessionsMu.Unlock()
 
-	clientAddr := conn.RemoteAddr().String()
-	fmt.Printf("New connection from %s\n", clientAddr)
+	// Idle sessions can go right away; busy ones close themselves after
+	// their current command
+	for _, session := range sessions {
+		session.closeIfIdle()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.sessionsWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		// Let the hooks catch up with the last events
+		return s.events.close(ctx)
+	case <-ctx.Done():
+	}
+
+	// Out of time: abort whatever is still running
+	s.sessionsMu.Lock()
+	for _, session := range s.sessions {
+		session.netConn.Close()
+		session.data.close()
+	}
+	s.sessionsMu.Unlock()
 
-	// Create a new session for this client
+	<-done
+	s.events.close(ctx)
+	return ctx.Err()
+}
+
+// isClosing reports whether Shutdown has been called
+func (s *FTPServer) isClosing() bool {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	return s.closing
+}
+
+// newSession creates and registers the session for a new connection. It
+// returns ErrServerClosed if the server is shutting down, or an error if a
+// session limit has been reached.
+func (s *FTPServer) newSession(conn net.Conn) (*Session, error) {
+	id := newSessionID()
 	session := &Session{
+		id:            id,
+		logger:        s.logger.With("session", id, "remote", conn.RemoteAddr().String()),
+		netConn:       conn,
 		conn:          conn,
 		controlReader: bufio.NewReader(conn),
 		controlWriter: bufio.NewWriter(conn),
+		data:          newDataChannel(s.dataTimeout),
+		rate:          newRateLimiters(s.sessionRate),
+		fs:            s.fs,
 		workDir:       "/",
-		authenticated: false, // We'll use a simple authentication mechanism
+		authenticated: false,
+		busy:          true, // until the welcome message has been sent
 	}
 
-	// Register the session
+	ip := addrIP(conn.RemoteAddr()).String()
+
 	s.sessionsMu.Lock()
-	s.sessions[clientAddr] = session
-	s.sessionsMu.Unlock()
+	defer s.sessionsMu.Unlock()
+	if s.closing {
+		return nil, ErrServerClosed
+	}
+	if !s.ipFilter.Permits(addrIP(conn.RemoteAddr())) {
+		return nil, errAddressNotAllowed
+	}
+	if s.guard.banned(ip) {
+		return nil, errAddressBanned
+	}
+	if s.maxSessions > 0 && len(s.sessions) >= s.maxSessions {
+		return nil, errTooManySessions
+	}
+	if s.maxPerIP > 0 && s.ipSessions[ip] >= s.maxPerIP {
+		return nil, errTooManyFromIP
+	}
+	s.sessions[conn.RemoteAddr().String()] = session
+	s.ipSessions[ip]++
+	s.sessionsWg.Add(1)
+	return session, nil
+}
+
+// reject tells a client that it can't be served and closes its connection
+func (s *FTPServer) reject(conn net.Conn, reason error) {
+	defer conn.Close()
+
+	s.logger.Warn("Connection rejected", "remote", conn.RemoteAddr().String(), "reason", reason)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "421 Service not available, %v\r\n", reason)
+}
+
+// handleClient processes a client connection
+func (s *FTPServer) handleClient(session *Session) {
+	conn := session.netConn
+	defer conn.Close()
+
+	clientAddr := conn.RemoteAddr().String()
+	ip := addrIP(conn.RemoteAddr()).String()
+	session.log().Info("New connection")
 
 	// Clean up when the client disconnects
 	defer func() {
 		s.sessionsMu.Lock()
 		delete(s.sessions, clientAddr)
+		if s.ipSessions[ip]--; s.ipSessions[ip] <= 0 {
+			delete(s.ipSessions, ip)
+		}
 		s.sessionsMu.Unlock()
-		if session.dataConn != nil {
-			session.dataConn.Close()
+		session.data.close()
+		session.discardUploads()
+		if session.user != nil {
+			s.emit(session, Event{Type: EventLogout})
 		}
+		s.sessionsWg.Done()
 	}()
 
 	// Send welcome message
 	session.writeResponse(220, "UltraFTP Server ready")
+	if !session.setIdle(s.isClosing()) {
+		return
+	}
 
 	// Process client commands
 	for {
+		// Give up on clients that stay silent too long
+		if s.idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		}
+
 		line, err := session.controlReader.ReadString('\n')
 		if err != nil {
-			fmt.Printf("Error reading from client: %v\n", err)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && session.setBusy() {
+				session.log().Info("Idle timeout")
+				session.writeResponse(421, "Idle timeout, closing control connection")
+			} else if !session.isClosed() {
+				session.log().Debug("Error reading from client", "error", err)
+			}
 			break
 		}
 
@@ -131,37 +597,122 @@ func (s *FTPServer) handleClient(conn net.Conn) {
 			param = parts[1]
 		}
 
-		// Handle the command
+		// Handle the command, unless Shutdown closed the session meanwhile
+		if !session.setBusy() {
+			break
+		}
 		if !s.handleCommand(session, command, param) {
 			break
 		}
+		if !session.setIdle(s.isClosing()) {
+			break
+		}
+	}
+
+	session.log().Info("Connection closed")
+}
+
+// setBusy marks the session as handling a command. It returns false if the
+// session has already been closed.
+func (s *Session) setBusy() bool {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.busy = true
+	return true
+}
+
+// setIdle marks the session as waiting for a command. If the server is
+// shutting down the session is closed instead and false is returned.
+func (s *Session) setIdle(shuttingDown bool) bool {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.busy = false
+	if shuttingDown && !s.closed {
+		s.closeLocked()
 	}
+	return !s.closed
+}
+
+// closeIfIdle closes the session if it isn't in the middle of a command
+func (s *Session) closeIfIdle() {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if !s.busy && !s.closed {
+		s.closeLocked()
+	}
+}
 
-	fmt.Printf("Connection from %s closed\n", clientAddr)
+// closeLocked tells the client the server is going away and closes the
+// connection. The caller must hold stateMu, and the session must not be
+// busy, so nothing else is writing to the control connection.
+func (s *Session) closeLocked() {
+	s.closed = true
+	s.netConn.SetWriteDeadline(time.Now().Add(time.Second))
+	s.writeResponse(421, "Server shutting down")
+	s.netConn.Close()
+}
+
+// isClosed reports whether the session was closed by the server
+func (s *Session) isClosed() bool {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.closed
+}
+
+// preAuthCommands are the commands accepted before the client has logged in
+var preAuthCommands = map[string]bool{
+	"USER": true,
+	"PASS": true,
+	"SYST": true,
+	"FEAT": true,
+	"NOOP": true,
+	"OPTS": true,
+	"QUIT": true,
+	"AUTH": true,
+	"PBSZ": true,
+	"PROT": true,
 }
 
 // handleCommand processes an FTP command
 func (s *FTPServer) handleCommand(session *Session, command, param string) bool {
-	fmt.Printf("Command: %s %s\n", command, param)
+	session.log().Debug("Command", "command", command, "param", redactParam(command, param))
+
+	// Count the command with the reply it finally got
+	defer func() { s.metrics.countCommand(command, session.lastReply) }()
+
+	if !session.authenticated && !preAuthCommands[command] {
+		session.writeResponse(530, "Not logged in")
+		return true
+	}
+
+	// A pending rename or restart offset only survives until the next command
+	renameFrom := session.renameFrom
+	session.renameFrom = ""
+	restOffset := session.restOffset
+	session.restOffset = 0
 
 	switch command {
 	case "USER":
-		// For simplicity, we'll accept any username
-		session.writeResponse(331, "User name okay, need password")
+		s.handleUser(session, param)
 	case "PASS":
-		// For simplicity, we'll accept any password
-		session.authenticated = true
-		session.writeResponse(230, "User logged in, proceed")
+		return s.handlePass(session, param)
 	case "SYST":
 		session.writeResponse(215, "UNIX Type: L8")
 	case "FEAT":
-		session.writeMultiResponse(211, []string{
-			"Features:",
-			" UTF8",
-			"End",
-		})
+		s.handleFeatures(session)
+	case "AUTH":
+		return s.handleAuth(session, param)
+	case "PBSZ":
+		s.handleProtectionBufferSize(session, param)
+	case "PROT":
+		s.handleProtectionLevel(session, param)
+	case "NOOP":
+		session.writeResponse(200, "NOOP ok")
 	case "PWD":
-		session.writeResponse(257, fmt.Sprintf("\"%s\" is the current directory", session.workDir))
+		session.writeResponse(257, fmt.Sprintf("\"%s\" is the current directory", quotePath(session.workDir)))
 	case "TYPE":
 		// We'll support both ASCII and binary mode, but won't differentiate
 		session.writeResponse(200, "Type set to "+param)
@@ -169,36 +720,46 @@ func (s *FTPServer) handleCommand(session *Session, command, param string) bool
 		s.handlePassive(session)
 	case "PORT":
 		s.handlePort(session, param)
+	case "EPSV":
+		s.handleExtendedPassive(session, param)
+	case "EPRT":
+		s.handleExtendedPort(session, param)
 	case "LIST":
-		if !session.authenticated {
-			session.writeResponse(530, "Not logged in")
-			return true
-		}
 		s.handleList(session, param)
+	case "NLST":
+		s.handleNameList(session, param)
+	case "MLSD":
+		s.handleMachineList(session, param)
+	case "MLST":
+		s.handleMachineListSingle(session, param)
+	case "MDTM":
+		s.handleModTime(session, param)
+	case "OPTS":
+		s.handleOptions(session, param)
 	case "RETR":
-		if !session.authenticated {
-			session.writeResponse(530, "Not logged in")
-			return true
-		}
-		s.handleRetrieve(session, param)
+		s.handleRetrieve(session, param, restOffset)
 	case "STOR":
-		if !session.authenticated {
-			session.writeResponse(530, "Not logged in")
-			return true
-		}
-		s.handleStore(session, param)
+		s.handleStore(session, param, restOffset, false)
+	case "APPE":
+		s.handleStore(session, param, 0, true)
+	case "REST":
+		s.handleRestart(session, param)
+	case "SIZE":
+		s.handleSize(session, param)
 	case "CWD":
-		if !session.authenticated {
-			session.writeResponse(530, "Not logged in")
-			return true
-		}
 		s.handleChangeDir(session, param)
 	case "CDUP":
-		if !session.authenticated {
-			session.writeResponse(530, "Not logged in")
-			return true
-		}
 		s.handleChangeDir(session, "..")
+	case "MKD", "XMKD":
+		s.handleMakeDir(session, param)
+	case "RMD", "XRMD":
+		s.handleRemoveDir(session, param)
+	case "DELE":
+		s.handleDelete(session, param)
+	case "RNFR":
+		s.handleRenameFrom(session, param)
+	case "RNTO":
+		s.handleRenameTo(session, renameFrom, param)
 	case "QUIT":
 		session.writeResponse(221, "Goodbye")
 		return false
@@ -209,23 +770,126 @@ func (s *FTPServer) handleCommand(session *Session, command, param string) bool
 	return true
 }
 
+// handleFeatures handles the FEAT command
+func (s *FTPServer) handleFeatures(session *Session) {
+	features := []string{"Features:"}
+	if s.tlsConfig != nil {
+		features = append(features, "AUTH TLS", "PBSZ", "PROT")
+	}
+	features = append(features, "EPRT", "EPSV", "MDTM", mlstFeature(), "REST STREAM", "SIZE", "UTF8", "End")
+	session.writeMultiResponse(211, features)
+}
+
+// handleUser handles the USER command
+func (s *FTPServer) handleUser(session *Session, param string) {
+	if param == "" {
+		session.writeResponse(501, "Syntax error in parameters or arguments")
+		return
+	}
+	if s.requireTLS && !session.tlsEnabled {
+		session.writeResponse(530, "TLS required, use AUTH TLS first")
+		return
+	}
+
+	// A new USER command always starts a fresh login
+	if session.user != nil {
+		s.emit(session, Event{Type: EventLogout})
+	}
+	session.pendingUser = param
+	session.user = nil
+	session.authenticated = false
+	session.writeResponse(331, "User name okay, need password")
+}
+
+// handlePass handles the PASS command. It returns false if the client has
+// been banned and the session has to be closed.
+func (s *FTPServer) handlePass(session *Session, param string) bool {
+	if session.authenticated {
+		session.writeResponse(230, "Already logged in")
+		return true
+	}
+	if session.pendingUser == "" {
+		session.writeResponse(503, "Login with USER first")
+		return true
+	}
+
+	username := session.pendingUser
+	session.pendingUser = ""
+	ip := addrIP(session.netConn.RemoteAddr()).String()
+
+	user, err := s.auth.Authenticate(username, param)
+	if err != nil && !errors.Is(err, ErrInvalidCredentials) {
+		session.log().Error("Error authenticating", "user", username, "error", err)
+		session.writeResponse(530, "Login incorrect")
+		return true
+	}
+
+	// The user may be restricted to certain networks. Logins from others
+	// fail like a wrong password, so that the reply doesn't give away that
+	// the password was right.
+	if err == nil && !user.IPFilter.Permits(addrIP(session.netConn.RemoteAddr())) {
+		session.log().Warn("Login refused from this address", "user", username)
+		err = ErrInvalidCredentials
+	} else if err != nil {
+		session.log().Warn("Login failed", "user", username)
+	}
+
+	if err != nil {
+		s.metrics.countLoginFailure()
+
+		// Slow down guessing, and ban addresses that keep at it
+		delay, banned := s.guard.failure(ip, username)
+		time.Sleep(delay)
+		if banned {
+			session.log().Warn("Address banned after repeated login failures", "ip", ip, "duration", s.guard.banDuration)
+			session.writeResponse(421, "Too many failed logins, closing control connection")
+			return false
+		}
+		session.writeResponse(530, "Login incorrect")
+		return true
+	}
+
+	s.guard.success(ip, username)
+
+	// Jail the session in the user's home directory
+	fsys, err := s.userFileSystem(user)
+	if err != nil {
+		session.log().Error("Cannot use home directory", "user", username, "home", user.HomeDir, "error", err)
+		session.writeResponse(530, "Home directory not available")
+		return true
+	}
+
+	session.user = user
+	session.permissions = newPermissionSet(user.Permissions, s.permMask)
+	session.fs = fsys
+	session.workDir = "/"
+	session.authenticated = true
+	session.log().Info("User logged in", "anonymous", user.Anonymous)
+	s.emit(session, Event{Type: EventLogin})
+	session.writeResponse(230, "User logged in, proceed")
+	return true
+}
+
 // writeResponse sends a response to the client
 func (s *Session) writeResponse(code int, message string) {
 	response := fmt.Sprintf("%d %s\r\n", code, message)
+	s.lastReply = code
 	s.controlWriter.WriteString(response)
 	s.controlWriter.Flush()
 }
 
 // writeMultiResponse sends a multi-line response to the client
 func (s *Session) writeMultiResponse(code int, messages []string) {
+	s.lastReply = code
+
 	// First line
 	s.controlWriter.WriteString(fmt.Sprintf("%d-%s\r\n", code, messages[0]))
-	
+
 	// Middle lines
 	for i := 1; i < len(messages)-1; i++ {
 		s.controlWriter.WriteString(fmt.Sprintf(" %s\r\n", messages[i]))
 	}
-	
+
 	// Last line
 	s.controlWriter.WriteString(fmt.Sprintf("%d %s\r\n", code, messages[len(messages)-1]))
 	s.controlWriter.Flush()
@@ -233,58 +897,93 @@ func (s *Session) writeMultiResponse(code int, messages []string) {
 
 // handlePassive handles the PASV command
 func (s *FTPServer) handlePassive(session *Session) {
-	// Close any existing data connection
-	if session.dataConn != nil {
-		session.dataConn.Close()
-		session.dataConn = nil
+	if session.epsvAll {
+		session.writeResponse(501, "PASV not allowed after EPSV ALL")
+		return
 	}
 
-	// Create a listener for the data connection
-	listener, err := net.Listen("tcp", ":0")
+	// PASV can only describe IPv4 addresses
+	ip, err := s.passiveIP(session)
 	if err != nil {
-		session.writeResponse(425, "Cannot open data connection")
+		session.log().Error("Error determining passive address", "error", err)
+		session.writeResponse(425, "Cannot use PASV on this connection, use EPSV")
 		return
 	}
 
-	// Get the port that was assigned
-	_, portStr, err := net.SplitHostPort(listener.Addr().String())
-	if err != nil {
-		listener.Close()
-		session.writeResponse(425, "Cannot open data connection")
+	port, ok := s.openPassive(session)
+	if !ok {
 		return
 	}
 
-	port, _ := strconv.Atoi(portStr)
-	p1 := port / 256
-	p2 := port % 256
-
-	// Get the local IP address
-	host, _, _ := net.SplitHostPort(session.conn.LocalAddr().String())
-	hostParts := strings.Split(host, ".")
-
 	// Send the passive mode response
-	response := fmt.Sprintf("Entering Passive Mode (%s,%s,%s,%s,%d,%d)",
-		hostParts[0], hostParts[1], hostParts[2], hostParts[3], p1, p2)
+	response := fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)",
+		ip[0], ip[1], ip[2], ip[3], port/256, port%256)
 	session.writeResponse(227, response)
+}
 
-	// Accept the data connection in a goroutine
-	go func() {
-		defer listener.Close()
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Printf("Error accepting data connection: %v\n", err)
+// handleExtendedPassive handles the EPSV command (RFC 2428)
+func (s *FTPServer) handleExtendedPassive(session *Session, param string) {
+	switch strings.ToUpper(param) {
+	case "":
+	case "ALL":
+		// The client promises to only use EPSV from now on
+		session.epsvAll = true
+		session.writeResponse(200, "EPSV ALL ok")
+		return
+	default:
+		// The client asked for a specific network protocol, which has to
+		// match the one used by the control connection
+		if param != networkProtocol(session.conn.LocalAddr()) {
+			session.writeResponse(522, fmt.Sprintf("Network protocol not supported, use (%s)", networkProtocol(session.conn.LocalAddr())))
 			return
 		}
-		session.dataConn = conn
-	}()
+	}
+
+	port, ok := s.openPassive(session)
+	if !ok {
+		return
+	}
+
+	session.writeResponse(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+}
+
+// openPassive starts listening for a passive data connection and returns
+// the port to advertise. On failure it replies to the client itself.
+func (s *FTPServer) openPassive(session *Session) (int, bool) {
+	// Give up any previous data connection first so its port can be reused
+	session.data.close()
+
+	// Create a listener for the data connection
+	var listener net.Listener
+	var err error
+	if s.ports != nil {
+		listener, err = s.ports.listen()
+	} else {
+		listener, err = net.Listen("tcp", ":0")
+	}
+	if err != nil {
+		if errors.Is(err, errNoPassivePorts) {
+			s.metrics.countPassiveExhausted()
+		}
+		session.log().Error("Error opening passive listener", "error", err)
+		session.writeResponse(425, "Cannot open data connection")
+		return 0, false
+	}
+
+	// Get the port that was assigned
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	// Accept the data connection in the background
+	session.data.listen(s.metrics.trackPassive(listener))
+
+	return port, true
 }
 
 // handlePort handles the PORT command
 func (s *FTPServer) handlePort(session *Session, param string) {
-	// Close any existing data connection
-	if session.dataConn != nil {
-		session.dataConn.Close()
-		session.dataConn = nil
+	if session.epsvAll {
+		session.writeResponse(501, "PORT not allowed after EPSV ALL")
+		return
 	}
 
 	// Parse the PORT command parameters
@@ -295,47 +994,156 @@ func (s *FTPServer) handlePort(session *Session, param string) {
 	}
 
 	// Extract the IP and port
-	ip := strings.Join(parts[0:4], ".")
-	p1, _ := strconv.Atoi(parts[4])
-	p2, _ := strconv.Atoi(parts[5])
-	port := p1*256 + p2
+	nums := make([]byte, 6)
+	for i, part := range parts {
+		n, err := strconv.ParseUint(strings.TrimSpace(part), 10, 8)
+		if err != nil {
+			session.writeResponse(501, "Invalid PORT command")
+			return
+		}
+		nums[i] = byte(n)
+	}
+	ip := net.IPv4(nums[0], nums[1], nums[2], nums[3])
+	port := int(nums[4])*256 + int(nums[5])
+
+	if s.connectActive(session, ip, port) {
+		session.writeResponse(200, "PORT command successful")
+	}
+}
+
+// handleExtendedPort handles the EPRT command (RFC 2428)
+func (s *FTPServer) handleExtendedPort(session *Session, param string) {
+	if session.epsvAll {
+		session.writeResponse(501, "EPRT not allowed after EPSV ALL")
+		return
+	}
+
+	// The parameter looks like |1|132.235.1.2|6275| where the first
+	// character is the delimiter
+	if len(param) < 2 {
+		session.writeResponse(501, "Invalid EPRT command")
+		return
+	}
+	fields := strings.Split(param[1:], param[:1])
+	if len(fields) != 4 || fields[3] != "" {
+		session.writeResponse(501, "Invalid EPRT command")
+		return
+	}
+
+	if fields[0] != "1" && fields[0] != "2" {
+		session.writeResponse(522, "Network protocol not supported, use (1,2)")
+		return
+	}
+
+	ip := net.ParseIP(fields[1])
+	if ip == nil || (fields[0] == "1") != (ip.To4() != nil) {
+		session.writeResponse(501, "Invalid EPRT address")
+		return
+	}
+
+	port, err := strconv.Atoi(fields[2])
+	if err != nil || port <= 0 || port > 65535 {
+		session.writeResponse(501, "Invalid EPRT port")
+		return
+	}
+
+	if s.connectActive(session, ip, port) {
+		session.writeResponse(200, "EPRT command successful")
+	}
+}
+
+// connectActive opens an active mode data connection to the client. On
+// failure it replies to the client itself.
+func (s *FTPServer) connectActive(session *Session, ip net.IP, port int) bool {
+	if !s.permitsDataAddress(session, ip) {
+		session.log().Warn("Refused data connection to filtered address", "target", ip.String())
+		session.writeResponse(501, "Data connection to this address not allowed")
+		return false
+	}
 
 	// Connect to the client's data port
-	addr := fmt.Sprintf("%s:%d", ip, port)
-	conn, err := net.Dial("tcp", addr)
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	conn, err := net.DialTimeout("tcp", addr, s.dataTimeout)
 	if err != nil {
 		session.writeResponse(425, "Cannot open data connection")
-		return
+		return false
 	}
 
-	session.dataConn = conn
-	session.writeResponse(200, "PORT command successful")
+	session.data.setConn(conn)
+	return true
+}
+
+// passiveIP returns the IPv4 address to advertise in a PASV reply
+func (s *FTPServer) passiveIP(session *Session) (net.IP, error) {
+	if s.publicHost == "" {
+		ip := addrIP(session.conn.LocalAddr()).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("control connection is not IPv4")
+		}
+		return ip, nil
+	}
+
+	// Look the public host up every time so dynamic DNS names keep working
+	if ip := net.ParseIP(s.publicHost); ip != nil {
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("public host %s is not an IPv4 address", s.publicHost)
+		}
+		return ip.To4(), nil
+	}
+	ips, err := net.LookupIP(s.publicHost)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("public host %s has no IPv4 address", s.publicHost)
+}
+
+// addrIP returns the IP address of a TCP address
+func addrIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, _ := net.SplitHostPort(addr.String())
+	return net.ParseIP(host)
+}
+
+// networkProtocol returns the RFC 2428 network protocol number of an
+// address, "1" for IPv4 and "2" for IPv6
+func networkProtocol(addr net.Addr) string {
+	if addrIP(addr).To4() != nil {
+		return "1"
+	}
+	return "2"
 }
 
 // handleList handles the LIST command
 func (s *FTPServer) handleList(session *Session, param string) {
-	if session.dataConn == nil {
+	if !session.data.ready() {
 		session.writeResponse(425, "Use PORT or PASV first")
 		return
 	}
 
 	// Ensure the data connection is closed when we're done
-	defer func() {
-		session.dataConn.Close()
-		session.dataConn = nil
-	}()
+	defer session.data.close()
 
-	// Determine the directory to list
+	// Determine the directory to list, ignoring any ls-style options
 	path := param
-	if path == "" || path == "-a" || path == "-l" {
-		path = session.workDir
+	if strings.HasPrefix(path, "-") {
+		_, path, _ = strings.Cut(path, " ")
 	}
 
-	// Convert the path to an absolute path in the server's filesystem
-	fullPath := filepath.Join(s.RootDir, filepath.Clean(path))
+	// Resolve the path against the working directory
+	virtualPath := session.resolvePath(path)
+	if !session.can(virtualPath, PermList) {
+		return
+	}
 
 	// Check if the path exists and is a directory
-	info, err := os.Stat(fullPath)
+	info, err := session.fs.Stat(virtualPath)
 	if err != nil {
 		session.writeResponse(550, "File not found")
 		return
@@ -344,22 +1152,25 @@ func (s *FTPServer) handleList(session *Session, param string) {
 	// Notify the client that we're about to send the listing
 	session.writeResponse(150, "Here comes the directory listing")
 
+	// Wait for the client to connect if it hasn't already
+	dataConn, err := s.openData(session)
+	if err != nil {
+		session.log().Warn("Error opening data connection", "error", err)
+		session.writeResponse(425, "Cannot open data connection")
+		return
+	}
+
 	// If it's a directory, list its contents
 	if info.IsDir() {
-		files, err := os.ReadDir(fullPath)
+		files, err := session.readDir(virtualPath)
 		if err != nil {
 			session.writeResponse(550, "Error reading directory")
 			return
 		}
 
 		// Send the directory listing
-		writer := bufio.NewWriter(session.dataConn)
-		for _, file := range files {
-			info, err := file.Info()
-			if err != nil {
-				continue
-			}
-
+		writer := bufio.NewWriter(dataConn)
+		for _, info := range files {
 			// Format: "-rw-r--r-- 1 owner group size month day time filename"
 			mode := info.Mode().String()
 			size := info.Size()
@@ -371,7 +1182,7 @@ func (s *FTPServer) handleList(session *Session, param string) {
 		writer.Flush()
 	} else {
 		// It's a file, just send its info
-		writer := bufio.NewWriter(session.dataConn)
+		writer := bufio.NewWriter(dataConn)
 		mode := info.Mode().String()
 		size := info.Size()
 		modTime := info.ModTime().Format("Jan 02 15:04")
@@ -385,24 +1196,25 @@ func (s *FTPServer) handleList(session *Session, param string) {
 	session.writeResponse(226, "Directory send OK")
 }
 
-// handleRetrieve handles the RETR command (download)
-func (s *FTPServer) handleRetrieve(session *Session, param string) {
-	if session.dataConn == nil {
+// handleRetrieve handles the RETR command (download), starting at offset
+// if it was preceded by REST
+func (s *FTPServer) handleRetrieve(session *Session, param string, offset int64) {
+	if !session.data.ready() {
 		session.writeResponse(425, "Use PORT or PASV first")
 		return
 	}
 
 	// Ensure the data connection is closed when we're done
-	defer func() {
-		session.dataConn.Close()
-		session.dataConn = nil
-	}()
+	defer session.data.close()
 
-	// Convert the path to an absolute path in the server's filesystem
-	fullPath := filepath.Join(s.RootDir, filepath.Clean(param))
+	// Resolve the path against the working directory
+	virtualPath := session.resolvePath(param)
+	if !session.can(virtualPath, PermDownload) {
+		return
+	}
 
 	// Check if the file exists
-	file, err := os.Open(fullPath)
+	file, err := session.fs.Open(virtualPath)
 	if err != nil {
 		session.writeResponse(550, "File not found")
 		return
@@ -415,81 +1227,215 @@ func (s *FTPServer) handleRetrieve(session *Session, param string) {
 		session.writeResponse(550, "Error accessing file")
 		return
 	}
+	if info.IsDir() {
+		session.writeResponse(550, "Not a regular file")
+		return
+	}
+
+	// Skip the part the client already has
+	if offset > 0 {
+		if offset > info.Size() {
+			session.writeResponse(554, "Restart offset beyond end of file")
+			return
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			session.writeResponse(554, "Cannot restart transfer")
+			return
+		}
+	}
 
 	// Notify the client that we're about to send the file
-	session.writeResponse(150, fmt.Sprintf("Opening data connection for %s (%d bytes)", param, info.Size()))
+	session.writeResponse(150, fmt.Sprintf("Opening data connection for %s (%d bytes)", param, info.Size()-offset))
+
+	// Wait for the client to connect if it hasn't already
+	dataConn, err := s.openData(session)
+	if err != nil {
+		session.log().Warn("Error opening data connection", "error", err)
+		session.writeResponse(425, "Cannot open data connection")
+		return
+	}
 
 	// Send the file
-	_, err = bufio.NewReader(file).WriteTo(session.dataConn)
+	start := time.Now()
+	n, err := bufio.NewReader(file).WriteTo(common.NewLimitedWriter(dataConn, s.downloadLimiters(session)...))
 	if err != nil {
-		fmt.Printf("Error sending file: %v\n", err)
+		session.log().Warn("Error sending file", "path", virtualPath, "error", err)
+		s.recordTransfer(session, start, virtualPath, xferOutgoing, n, false)
+		session.writeResponse(426, "Connection closed; transfer aborted")
 		return
 	}
+	s.recordTransfer(session, start, virtualPath, xferOutgoing, n, true)
+	s.emit(session, Event{Type: EventDownload, Path: virtualPath, Size: n})
 
 	// Notify the client that the transfer is complete
 	session.writeResponse(226, "Transfer complete")
 }
 
-// handleStore handles the STOR command (upload)
-func (s *FTPServer) handleStore(session *Session, param string) {
-	if session.dataConn == nil {
+// handleStore handles the STOR and APPE commands (upload). A STOR preceded
+// by REST overwrites the file from offset onwards; APPE appends to it.
+func (s *FTPServer) handleStore(session *Session, param string, offset int64, appendMode bool) {
+	if !session.data.ready() {
 		session.writeResponse(425, "Use PORT or PASV first")
 		return
 	}
 
 	// Ensure the data connection is closed when we're done
-	defer func() {
-		session.dataConn.Close()
-		session.dataConn = nil
-	}()
+	defer session.data.close()
 
-	// Convert the path to an absolute path in the server's filesystem
-	fullPath := filepath.Join(s.RootDir, filepath.Clean(param))
+	// Resolve the path against the working directory
+	virtualPath := session.resolvePath(param)
+	if !session.allowName(virtualPath) {
+		return
+	}
 
-	// Create the file
-	file, err := os.Create(fullPath)
+	// Changing an existing file needs more than creating a new one
+	existing, err := session.fs.Stat(virtualPath)
+	if err == nil {
+		if existing.IsDir() {
+			session.writeResponse(550, "Is a directory")
+			return
+		}
+		if !session.can(virtualPath, PermOverwrite) {
+			return
+		}
+	} else if !session.can(path.Dir(virtualPath), PermUpload) {
+		return
+	}
+
+	// Resuming needs a file at least as long as the restart offset
+	if offset > 0 && (existing == nil || offset > existing.Size()) {
+		session.writeResponse(554, "Restart offset beyond end of file")
+		return
+	}
+
+	// Create the file, keeping existing contents when resuming or appending.
+	// New contents go to a hidden file that replaces the target only once
+	// the upload is complete, so readers never see a partial file and a
+	// failed upload leaves the previous version intact, unless the file
+	// system already works that way.
+	writePath := virtualPath
+	flags := os.O_WRONLY
+	switch {
+	case appendMode:
+		flags |= os.O_CREATE | os.O_APPEND
+	case offset > 0:
+	case createsAtomically(session.fs, virtualPath):
+		flags |= os.O_CREATE | os.O_TRUNC
+	default:
+		writePath = uploadTempPath(virtualPath)
+		flags |= os.O_CREATE | os.O_EXCL
+		session.trackUpload(writePath)
+		defer session.discardUpload(writePath)
+	}
+	file, err := session.fs.OpenFile(writePath, flags, 0644)
 	if err != nil {
 		session.writeResponse(550, "Cannot create file")
 		return
 	}
-	defer file.Close()
+	// Unless the upload completes below, don't let file systems that store
+	// data on Close store a partial file
+	defer abortFile(file)
+
+	// Drop anything past the restart offset and continue writing from there
+	if offset > 0 {
+		info, err := file.Stat()
+		if err != nil || offset > info.Size() {
+			session.writeResponse(554, "Restart offset beyond end of file")
+			return
+		}
+		if err := file.Truncate(offset); err != nil {
+			session.writeResponse(554, "Cannot restart transfer")
+			return
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			session.writeResponse(554, "Cannot restart transfer")
+			return
+		}
+	}
 
 	// Notify the client that we're ready to receive the file
 	session.writeResponse(150, "Ok to send data")
 
+	// Wait for the client to connect if it hasn't already
+	dataConn, err := s.openData(session)
+	if err != nil {
+		session.log().Warn("Error opening data connection", "error", err)
+		session.writeResponse(425, "Cannot open data connection")
+		return
+	}
+
 	// Receive the file
-	_, err = bufio.NewReader(session.dataConn).WriteTo(file)
+	start := time.Now()
+	n, err := bufio.NewReader(common.NewLimitedReader(dataConn, s.uploadLimiters(session)...)).WriteTo(file)
 	if err != nil {
-		fmt.Printf("Error receiving file: %v\n", err)
+		session.log().Warn("Error receiving file", "path", virtualPath, "error", err)
+		s.recordTransfer(session, start, virtualPath, xferIncoming, n, false)
+		session.writeResponse(426, "Connection closed; transfer aborted")
+		return
+	}
+
+	// Some file systems only store the data once the file is closed
+	if err := file.Close(); err != nil {
+		session.log().Error("Error storing file", "path", virtualPath, "error", err)
+		s.recordTransfer(session, start, virtualPath, xferIncoming, n, false)
+		session.writeResponse(451, "Error storing file")
 		return
 	}
+	if writePath != virtualPath {
+		if err := session.commitUpload(writePath, virtualPath); err != nil {
+			session.log().Error("Error moving upload into place", "path", virtualPath, "error", err)
+			s.recordTransfer(session, start, virtualPath, xferIncoming, n, false)
+			session.writeResponse(451, "Error storing file")
+			return
+		}
+	}
+	s.recordTransfer(session, start, virtualPath, xferIncoming, n, true)
+	s.emit(session, Event{Type: EventUpload, Path: virtualPath, Size: n})
 
 	// Notify the client that the transfer is complete
 	session.writeResponse(226, "Transfer complete")
 }
 
-// handleChangeDir handles the CWD command
-func (s *FTPServer) handleChangeDir(session *Session, param string) {
-	// Handle absolute paths
-	var newPath string
-	if strings.HasPrefix(param, "/") {
-		newPath = param
-	} else {
-		// Handle relative paths
-		newPath = filepath.Join(session.workDir, param)
+// handleRestart handles the REST command, which sets the offset for the
+// next RETR or STOR
+func (s *FTPServer) handleRestart(session *Session, param string) {
+	offset, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || offset < 0 {
+		session.writeResponse(501, "Invalid restart offset")
+		return
 	}
 
-	// Clean up the path
-	newPath = filepath.Clean(newPath)
-	if !strings.HasPrefix(newPath, "/") {
-		newPath = "/" + newPath
+	session.restOffset = offset
+	session.writeResponse(350, fmt.Sprintf("Restarting at %d. Send RETR or STOR to continue", offset))
+}
+
+// handleSize handles the SIZE command (RFC 3659)
+func (s *FTPServer) handleSize(session *Session, param string) {
+	virtualPath := session.resolvePath(param)
+	if !session.can(virtualPath, PermList) {
+		return
+	}
+
+	info, err := session.fs.Stat(virtualPath)
+	if err != nil {
+		session.writeResponse(550, "File not found")
+		return
+	}
+	if !info.Mode().IsRegular() {
+		session.writeResponse(550, "Not a regular file")
+		return
 	}
 
-	// Convert to server filesystem path
-	fullPath := filepath.Join(s.RootDir, newPath)
+	session.writeResponse(213, strconv.FormatInt(info.Size(), 10))
+}
+
+// handleChangeDir handles the CWD command
+func (s *FTPServer) handleChangeDir(session *Session, param string) {
+	// Resolve the new directory relative to the current one
+	newPath := session.resolvePath(param)
 
 	// Check if the directory exists
-	info, err := os.Stat(fullPath)
+	info, err := session.fs.Stat(newPath)
 	if err != nil || !info.IsDir() {
 		session.writeResponse(550, "Directory not found")
 		return
@@ -499,3 +1445,165 @@ func (s *FTPServer) handleChangeDir(session *Session, param string) {
 	session.workDir = newPath
 	session.writeResponse(250, "Directory successfully changed")
 }
+
+// handleMakeDir handles the MKD command
+func (s *FTPServer) handleMakeDir(session *Session, param string) {
+	if param == "" {
+		session.writeResponse(501, "Syntax error in parameters or arguments")
+		return
+	}
+
+	virtualPath := session.resolvePath(param)
+	if !session.allowName(virtualPath) {
+		return
+	}
+	if !session.can(path.Dir(virtualPath), PermMkdir) {
+		return
+	}
+
+	if err := session.fs.Mkdir(virtualPath, 0755); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			session.writeResponse(550, "Directory already exists")
+		} else {
+			session.writeResponse(550, "Cannot create directory")
+		}
+		return
+	}
+
+	s.emit(session, Event{Type: EventMkdir, Path: virtualPath})
+	session.writeResponse(257, fmt.Sprintf("\"%s\" directory created", quotePath(virtualPath)))
+}
+
+// handleRemoveDir handles the RMD command
+func (s *FTPServer) handleRemoveDir(session *Session, param string) {
+	if param == "" {
+		session.writeResponse(501, "Syntax error in parameters or arguments")
+		return
+	}
+
+	virtualPath := session.resolvePath(param)
+	if virtualPath == "/" {
+		session.writeResponse(550, "Cannot remove directory")
+		return
+	}
+	if !session.can(path.Dir(virtualPath), PermDelete) {
+		return
+	}
+
+	// Make sure we're removing a directory and not a file
+	info, err := session.fs.Stat(virtualPath)
+	if err != nil || !info.IsDir() {
+		session.writeResponse(550, "Directory not found")
+		return
+	}
+
+	// Remove only removes empty directories
+	if err := session.fs.Remove(virtualPath); err != nil {
+		session.writeResponse(550, "Cannot remove directory")
+		return
+	}
+
+	s.emit(session, Event{Type: EventDelete, Path: virtualPath})
+	session.writeResponse(250, "Directory removed")
+}
+
+// handleDelete handles the DELE command
+func (s *FTPServer) handleDelete(session *Session, param string) {
+	if param == "" {
+		session.writeResponse(501, "Syntax error in parameters or arguments")
+		return
+	}
+
+	virtualPath := session.resolvePath(param)
+	if !session.can(path.Dir(virtualPath), PermDelete) {
+		return
+	}
+
+	// Make sure we're deleting a file and not a directory
+	info, err := session.fs.Stat(virtualPath)
+	if err != nil {
+		session.writeResponse(550, "File not found")
+		return
+	}
+	if info.IsDir() {
+		session.writeResponse(550, "Is a directory, use RMD")
+		return
+	}
+
+	if err := session.fs.Remove(virtualPath); err != nil {
+		session.writeResponse(550, "Cannot delete file")
+		return
+	}
+
+	s.emit(session, Event{Type: EventDelete, Path: virtualPath})
+	session.writeResponse(250, "File deleted")
+}
+
+// handleRenameFrom handles the RNFR command, the first half of a rename
+func (s *FTPServer) handleRenameFrom(session *Session, param string) {
+	if param == "" {
+		session.writeResponse(501, "Syntax error in parameters or arguments")
+		return
+	}
+
+	virtualPath := session.resolvePath(param)
+	if virtualPath == "/" {
+		session.writeResponse(550, "File not found")
+		return
+	}
+	if !session.can(path.Dir(virtualPath), PermRename) {
+		return
+	}
+
+	if _, err := session.fs.Stat(virtualPath); err != nil {
+		session.writeResponse(550, "File not found")
+		return
+	}
+
+	// Remember the source until RNTO arrives
+	session.renameFrom = virtualPath
+	session.writeResponse(350, "Ready for RNTO")
+}
+
+// handleRenameTo handles the RNTO command, completing a rename started by RNFR
+func (s *FTPServer) handleRenameTo(session *Session, renameFrom, param string) {
+	if renameFrom == "" {
+		session.writeResponse(503, "Use RNFR first")
+		return
+	}
+	if param == "" {
+		session.writeResponse(501, "Syntax error in parameters or arguments")
+		return
+	}
+
+	virtualPath := session.resolvePath(param)
+	if virtualPath == "/" {
+		session.writeResponse(553, "Cannot rename file")
+		return
+	}
+	if !session.allowName(virtualPath) {
+		return
+	}
+	if !session.can(path.Dir(virtualPath), PermRename) {
+		return
+	}
+
+	// Renaming onto an existing file replaces it
+	if _, err := session.fs.Stat(virtualPath); err == nil && !session.can(virtualPath, PermOverwrite) {
+		return
+	}
+
+	if err := session.fs.Rename(renameFrom, virtualPath); err != nil {
+		session.writeResponse(553, "Cannot rename file")
+		return
+	}
+
+	s.emit(session, Event{Type: EventRename, Path: virtualPath, OldPath: renameFrom})
+	session.writeResponse(250, "Rename successful")
+}
+
+// quotePath escapes a path for use inside a quoted 257 reply, where any
+// double quote must be doubled
+func quotePath(p string) string {
+	return strings.ReplaceAll(p, "\"", "\"\"")
+}
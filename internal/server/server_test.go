@@ -0,0 +1,590 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a server on a free loopback port, serving a new
+// in-memory file system, unless opts has one, to anonymous users who may
+// do everything
+func newTestServer(t *testing.T, opts Options) (*FTPServer, *MemFileSystem) {
+	t.Helper()
+	var fsys *MemFileSystem
+	if opts.FileSystem == nil {
+		fsys = NewMemFileSystem()
+		opts.FileSystem = fsys
+	}
+	opts.AllowAnonymous = true
+	if opts.AnonymousPermissions == nil {
+		opts.AnonymousPermissions = []PermissionRule{{Path: "/", Allow: PermAll}}
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	srv, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.Serve(ctx)
+	}()
+	t.Cleanup(func() {
+		shutdownCtx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+		defer stop()
+		srv.Shutdown(shutdownCtx)
+		cancel()
+		<-done
+	})
+	return srv, fsys
+}
+
+// testClient is a minimal FTP client that checks every reply
+type testClient struct {
+	t       *testing.T
+	netConn net.Conn
+	conn    *textproto.Conn
+	// rest is the offset to restart the next transfer at, if not zero
+	rest int64
+}
+
+// connect connects to a test server and reads the greeting
+func connect(t *testing.T, srv *FTPServer) *testClient {
+	t.Helper()
+	port := srv.Addr().(*net.TCPAddr).Port
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, netConn: conn, conn: textproto.NewConn(conn)}
+	t.Cleanup(func() { conn.Close() })
+
+	c.expect(220)
+	return c
+}
+
+// dial connects to a test server and logs in anonymously
+func dial(t *testing.T, srv *FTPServer) *testClient {
+	t.Helper()
+	c := connect(t, srv)
+	c.cmd(331, "USER anonymous")
+	c.cmd(230, "PASS test@example.com")
+	return c
+}
+
+// startTLS secures the control connection with AUTH TLS
+func (c *testClient) startTLS() {
+	c.t.Helper()
+	c.cmd(234, "AUTH TLS")
+	conn := tls.Client(c.netConn, &tls.Config{InsecureSkipVerify: true})
+	if err := conn.Handshake(); err != nil {
+		c.t.Fatal(err)
+	}
+	c.netConn = conn
+	c.conn = textproto.NewConn(conn)
+}
+
+// cmd sends a command and checks the reply code, returning the message
+func (c *testClient) cmd(code int, format string, args ...any) string {
+	c.t.Helper()
+	if _, err := c.conn.Cmd(format, args...); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.expect(code)
+}
+
+// expect reads a reply and checks its code
+func (c *testClient) expect(code int) string {
+	c.t.Helper()
+	got, msg, err := c.conn.ReadResponse(0)
+	if err != nil {
+		c.t.Fatalf("reading reply: %v", err)
+	}
+	if got != code {
+		c.t.Fatalf("got reply %d %q, want %d", got, msg, code)
+	}
+	return msg
+}
+
+// passive sets up a passive data connection with EPSV and connects to it
+func (c *testClient) passive() net.Conn {
+	c.t.Helper()
+	msg := c.cmd(229, "EPSV")
+	start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+	if start < 0 || end < start {
+		c.t.Fatalf("malformed EPSV reply %q", msg)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", msg[start+4:end]))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	// REST has to come right before the transfer command
+	if c.rest != 0 {
+		c.cmd(350, "REST %d", c.rest)
+		c.rest = 0
+	}
+	return conn
+}
+
+// store uploads data with a STOR or APPE command
+func (c *testClient) store(command string, data []byte) {
+	c.t.Helper()
+	conn := c.passive()
+	c.cmd(150, command)
+	if _, err := conn.Write(data); err != nil {
+		c.t.Fatal(err)
+	}
+	conn.Close()
+	c.expect(226)
+}
+
+// retrieve downloads the output of a RETR or listing command
+func (c *testClient) retrieve(command string) []byte {
+	c.t.Helper()
+	conn := c.passive()
+	defer conn.Close()
+	c.cmd(150, command)
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.expect(226)
+	return data
+}
+
+func TestStoreRetrieve(t *testing.T) {
+	srv, fsys := newTestServer(t, Options{})
+	c := dial(t, srv)
+
+	data := bytes.Repeat([]byte("0123456789"), 100_000)
+	c.store("STOR file.bin", data)
+	if got := readFile(t, fsys, "/file.bin"); !bytes.Equal(got, data) {
+		t.Errorf("stored %d bytes, want %d", len(got), len(data))
+	}
+	if got := c.cmd(213, "SIZE file.bin"); got != strconv.Itoa(len(data)) {
+		t.Errorf("SIZE = %s", got)
+	}
+	if got := c.retrieve("RETR file.bin"); !bytes.Equal(got, data) {
+		t.Errorf("retrieved %d bytes, want %d", len(got), len(data))
+	}
+
+	// Replacing a file leaves no temporary files behind
+	c.store("STOR file.bin", []byte("new"))
+	if got := readFile(t, fsys, "/file.bin"); string(got) != "new" {
+		t.Errorf("replaced file contains %q", got)
+	}
+	if got := dirNames(t, fsys, "/"); !equalStrings(got, []string{"file.bin"}) {
+		t.Errorf("directory contains %q", got)
+	}
+
+	c.passive().Close()
+	c.cmd(550, "RETR missing")
+
+	// Directories can't be replaced by uploads
+	c.cmd(257, "MKD dir")
+	c.passive().Close()
+	c.cmd(550, "STOR dir")
+	c.passive().Close()
+	c.cmd(550, "APPE dir")
+}
+
+func TestRestart(t *testing.T) {
+	srv, fsys := newTestServer(t, Options{})
+	c := dial(t, srv)
+	c.store("STOR file", []byte("hello world"))
+
+	c.rest = 6
+	if got := c.retrieve("RETR file"); string(got) != "world" {
+		t.Errorf("RETR after REST 6 = %q", got)
+	}
+
+	c.rest = 5
+	c.store("STOR file", []byte(", there"))
+	if got := readFile(t, fsys, "/file"); string(got) != "hello, there" {
+		t.Errorf("STOR after REST 5 gave %q", got)
+	}
+
+	// The offset only applies to the next transfer
+	if got := c.retrieve("RETR file"); string(got) != "hello, there" {
+		t.Errorf("RETR after a restarted transfer = %q", got)
+	}
+
+	c.rest = 100
+	c.passive().Close()
+	c.cmd(554, "STOR file")
+	c.rest = 5
+	c.passive().Close()
+	c.cmd(554, "STOR missing")
+	if _, err := fsys.Stat("/missing"); err == nil {
+		t.Error("STOR with a bad restart offset created the file")
+	}
+	c.cmd(501, "REST -1")
+}
+
+func TestAppend(t *testing.T) {
+	srv, fsys := newTestServer(t, Options{})
+	c := dial(t, srv)
+
+	c.store("APPE log", []byte("one\n"))
+	c.store("APPE log", []byte("two\n"))
+	if got := readFile(t, fsys, "/log"); string(got) != "one\ntwo\n" {
+		t.Errorf("appended file contains %q", got)
+	}
+}
+
+func TestRename(t *testing.T) {
+	srv, fsys := newTestServer(t, Options{})
+	c := dial(t, srv)
+	c.store("STOR old", []byte("data"))
+	c.cmd(257, "MKD dir")
+
+	c.cmd(350, "RNFR old")
+	c.cmd(250, "RNTO dir/new")
+	if _, err := fsys.Stat("/old"); err == nil {
+		t.Error("old name still exists")
+	}
+	if got := readFile(t, fsys, "/dir/new"); string(got) != "data" {
+		t.Errorf("renamed file contains %q", got)
+	}
+
+	c.cmd(503, "RNTO other")
+	c.cmd(550, "RNFR missing")
+	c.cmd(350, "RNFR dir")
+	c.cmd(250, "RNTO dir2")
+	if got := dirNames(t, fsys, "/"); !equalStrings(got, []string{"dir2/"}) {
+		t.Errorf("directory contains %q", got)
+	}
+}
+
+// TestStoreLongName checks that files can be uploaded under names as long
+// as the file system allows
+func TestStoreLongName(t *testing.T) {
+	fsys, err := NewOSFileSystem(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := newTestServer(t, Options{FileSystem: fsys})
+	c := dial(t, srv)
+
+	name := strings.Repeat("x", 255)
+	c.store("STOR "+name, []byte("data"))
+	if got := readFile(t, fsys, "/"+name); string(got) != "data" {
+		t.Errorf("file contains %q", got)
+	}
+}
+
+// TestReservedNames checks that clients can't create files that would
+// pass for temporary upload files
+func TestReservedNames(t *testing.T) {
+	srv, fsys := newTestServer(t, Options{})
+	c := dial(t, srv)
+	c.store("STOR file", []byte("data"))
+
+	name := uploadTempPrefix + "file"
+	c.passive().Close()
+	c.cmd(553, "STOR %s", name)
+	c.passive().Close()
+	c.cmd(553, "APPE %s", name)
+	c.cmd(553, "MKD %s", name)
+	c.cmd(350, "RNFR file")
+	c.cmd(553, "RNTO %s", name)
+	if got := dirNames(t, fsys, "/"); !equalStrings(got, []string{"file"}) {
+		t.Errorf("directory contains %q", got)
+	}
+}
+
+func TestMLSD(t *testing.T) {
+	srv, _ := newTestServer(t, Options{})
+	c := dial(t, srv)
+	c.store("STOR file.txt", []byte("12345"))
+	c.cmd(257, "MKD sub")
+
+	lines := strings.Split(strings.TrimSpace(string(c.retrieve("MLSD"))), "\r\n")
+	facts := make(map[string]string)
+	for _, line := range lines {
+		fact, name, ok := strings.Cut(line, " ")
+		if !ok {
+			t.Fatalf("malformed MLSD line %q", line)
+		}
+		facts[name] = fact
+	}
+	if fact := facts["file.txt"]; !strings.Contains(fact, "type=file;") || !strings.Contains(fact, "size=5;") {
+		t.Errorf("facts of file.txt = %q", fact)
+	}
+	if fact := facts["sub"]; !strings.Contains(fact, "type=dir;") {
+		t.Errorf("facts of sub = %q", fact)
+	}
+	if fact := facts["."]; !strings.Contains(fact, "type=cdir;") {
+		t.Errorf("facts of . = %q", fact)
+	}
+
+	if got := c.cmd(200, "OPTS MLST size;bogus"); got != "MLST OPTS size;" {
+		t.Errorf("OPTS MLST reply %q", got)
+	}
+	if got := c.cmd(250, "MLST file.txt"); !strings.Contains(got, "\n size=5; /file.txt") {
+		t.Errorf("MLST with only size selected = %q", got)
+	}
+	if got := c.cmd(200, "OPTS MLST"); got != "MLST OPTS" {
+		t.Errorf("OPTS MLST with no facts reply %q", got)
+	}
+	if got := c.cmd(250, "MLST file.txt"); !strings.Contains(got, "\n  /file.txt") {
+		t.Errorf("MLST with no facts selected = %q", got)
+	}
+
+	c.passive().Close()
+	c.cmd(550, "MLSD missing")
+}
+
+// TestMLSTReadOnly checks that the perm fact leaves out what read-only
+// file systems don't allow
+func TestMLSTReadOnly(t *testing.T) {
+	readOnly := NewMemFileSystem()
+	writeFile(t, readOnly, "/file", []byte("data"))
+	srv, fsys := newTestServer(t, Options{Mounts: []Mount{{Path: "/ro", FileSystem: ReadOnly(readOnly)}}})
+	writeFile(t, fsys, "/file", []byte("data"))
+	c := dial(t, srv)
+
+	tests := []struct {
+		path, perm string
+	}{
+		{"/file", "perm=adfrw;"},
+		{"/ro", "perm=el;"},
+		{"/ro/file", "perm=r;"},
+	}
+	for _, tt := range tests {
+		if got := c.cmd(250, "MLST %s", tt.path); !strings.Contains(got, tt.perm) {
+			t.Errorf("MLST %s = %q, want %s", tt.path, got, tt.perm)
+		}
+	}
+
+	srv, _ = newTestServer(t, Options{ReadOnly: true})
+	c = dial(t, srv)
+	if got := c.cmd(250, "MLST /"); !strings.Contains(got, "perm=el;") {
+		t.Errorf("MLST / on a read-only server = %q", got)
+	}
+}
+
+func TestAnonymousPermissions(t *testing.T) {
+	srv, _ := newTestServer(t, Options{AnonymousPermissions: []PermissionRule{}})
+	c := dial(t, srv)
+
+	c.retrieve("MLSD")
+	c.cmd(550, "MKD dir")
+	c.passive().Close()
+	c.cmd(550, "STOR file")
+}
+
+// testAuthenticator accepts a single user
+type testAuthenticator struct {
+	user     User
+	password string
+}
+
+func (a *testAuthenticator) Authenticate(username, password string) (*User, error) {
+	if username != a.user.Name || password != a.password {
+		return nil, ErrInvalidCredentials
+	}
+	user := a.user
+	return &user, nil
+}
+
+// TestLoginFromDeniedNetwork checks that a login from a network the user
+// may not log in from can't be told apart from a wrong password, and
+// counts towards a ban
+func TestLoginFromDeniedNetwork(t *testing.T) {
+	filter, err := ParseIPFilter(nil, []string{"127.0.0.0/8", "::1/128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := newTestServer(t, Options{
+		Authenticator:     &testAuthenticator{user: User{Name: "alice", IPFilter: filter}, password: "secret"},
+		LoginFailureDelay: time.Millisecond,
+		MaxLoginFailures:  3,
+		BanDuration:       time.Minute,
+	})
+	c := connect(t, srv)
+
+	c.cmd(331, "USER alice")
+	wrong := c.cmd(530, "PASS wrong")
+	c.cmd(331, "USER alice")
+	if right := c.cmd(530, "PASS secret"); right != wrong {
+		t.Errorf("right password from a denied network got %q, wrong one %q", right, wrong)
+	}
+
+	// The right password doesn't reset the count of failures
+	c.cmd(331, "USER alice")
+	c.cmd(421, "PASS secret")
+}
+
+// eventRecorder is an EventSink that passes events on to a channel
+type eventRecorder chan Event
+
+func (r eventRecorder) Send(ctx context.Context, event Event) error {
+	r <- event
+	return nil
+}
+
+// next returns the next event, failing the test if none arrives
+func (r eventRecorder) next(t *testing.T) Event {
+	t.Helper()
+	select {
+	case event := <-r:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+		return Event{}
+	}
+}
+
+// TestAuthTLSLogout checks that AUTH TLS ends an existing login with a
+// logout event, as the login has to be repeated
+func TestAuthTLSLogout(t *testing.T) {
+	config, err := SelfSignedTLSConfig([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(eventRecorder, 10)
+	srv, _ := newTestServer(t, Options{TLSConfig: config, EventSinks: []EventSink{events}})
+	c := dial(t, srv)
+	c.startTLS()
+	c.cmd(331, "USER anonymous")
+	c.cmd(230, "PASS test@example.com")
+
+	for _, want := range []EventType{EventLogin, EventLogout, EventLogin} {
+		if event := events.next(t); event.Type != want {
+			t.Fatalf("got %s event, want %s", event.Type, want)
+		}
+	}
+}
+
+// TestConcurrentTransfers runs sessions side by side, so that the race
+// detector can check the data connection handling
+func TestConcurrentTransfers(t *testing.T) {
+	srv, _ := newTestServer(t, Options{DataTimeout: time.Second})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := dial(t, srv)
+			name := fmt.Sprintf("file%d", i)
+			data := bytes.Repeat([]byte{byte(i)}, 256<<10)
+			for j := 0; j < 5; j++ {
+				c.store("STOR "+name, data)
+				if got := c.retrieve("RETR " + name); !bytes.Equal(got, data) {
+					t.Errorf("%s: retrieved %d bytes, want %d", name, len(got), len(data))
+				}
+				c.retrieve("MLSD")
+
+				// Replace a passive listener before it's used
+				c.cmd(229, "EPSV")
+			}
+			c.cmd(221, "QUIT")
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestDataConnectionTimeout checks that a transfer gives up when the client
+// never connects to the passive port
+func TestDataConnectionTimeout(t *testing.T) {
+	srv, _ := newTestServer(t, Options{DataTimeout: 100 * time.Millisecond})
+	c := dial(t, srv)
+	c.store("STOR file", []byte("data"))
+
+	c.cmd(229, "EPSV")
+	c.cmd(150, "RETR file")
+	c.expect(425)
+	c.cmd(425, "RETR file")
+}
+
+// TestSessionClosedDuringTransfer checks that a session ending in the
+// middle of an upload cleans up after itself
+func TestSessionClosedDuringTransfer(t *testing.T) {
+	srv, fsys := newTestServer(t, Options{})
+	c := dial(t, srv)
+	c.store("STOR file", []byte("old"))
+
+	c.abortStore("STOR file", []byte("partial"))
+	waitForSessions(t, srv)
+	if got := readFile(t, fsys, "/file"); string(got) != "old" {
+		t.Errorf("file replaced by an aborted upload: %q", got)
+	}
+	if got := dirNames(t, fsys, "/"); !equalStrings(got, []string{"file"}) {
+		t.Errorf("directory contains %q", got)
+	}
+}
+
+// TestStoreAtomicCreate checks that uploads to file systems that create
+// files atomically are written in place
+func TestStoreAtomicCreate(t *testing.T) {
+	fsys, fake := newTestS3FileSystem(t)
+	srv, _ := newTestServer(t, Options{FileSystem: fsys})
+	c := dial(t, srv)
+
+	c.store("STOR file", []byte("old"))
+	if got, _ := fake.object("root/file"); string(got) != "old" {
+		t.Errorf("object contains %q", got)
+	}
+	if fake.count("CopyObject") != 0 || fake.count("DeleteObject") != 0 {
+		t.Error("upload went through a temporary object")
+	}
+
+	c.abortStore("STOR file", bytes.Repeat([]byte("x"), minS3PartSize+1))
+	waitForSessions(t, srv)
+	if got, _ := fake.object("root/file"); string(got) != "old" {
+		t.Errorf("object replaced by an aborted upload with %d bytes", len(got))
+	}
+	if fake.pendingUploads() != 0 {
+		t.Error("aborted multipart upload left behind")
+	}
+}
+
+// abortStore starts an upload and drops the connection part way through
+func (c *testClient) abortStore(command string, data []byte) {
+	c.t.Helper()
+	conn := c.passive()
+	c.cmd(150, command)
+	conn.Write(data)
+	c.conn.Close()
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+}
+
+// waitForSessions waits until every session of a server has ended
+func waitForSessions(t *testing.T, srv *FTPServer) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv.sessionsMu.Lock()
+		n := len(srv.sessions)
+		srv.sessionsMu.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions still open", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
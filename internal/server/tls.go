@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// LoadTLSConfig loads a certificate and private key from PEM files and
+// returns a TLS configuration for the server
+func LoadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load TLS certificate: %w", err)
+	}
+	return newTLSConfig(cert), nil
+}
+
+// SelfSignedTLSConfig generates a self-signed certificate for the given
+// host names and returns a TLS configuration using it. It is meant for
+// local testing; clients have to skip verification or pin the certificate.
+func SelfSignedTLSConfig(hosts []string) (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate serial number: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"UltraFTP"}, CommonName: "UltraFTP self-signed"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	// Add the host names and addresses the certificate is valid for
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create certificate: %w", err)
+	}
+
+	return newTLSConfig(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}), nil
+}
+
+// DefaultSelfSignedHosts returns the host names a self-signed certificate
+// should cover when none are given: localhost and this machine's hostname
+func DefaultSelfSignedHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname)
+	}
+	return hosts
+}
+
+// CertificateFingerprint returns the SHA-256 fingerprint of the leaf
+// certificate of a TLS configuration, as hex
+func CertificateFingerprint(config *tls.Config) string {
+	if len(config.Certificates) == 0 || len(config.Certificates[0].Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(config.Certificates[0].Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// newTLSConfig returns a server TLS configuration for a certificate
+func newTLSConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// handleAuth handles the AUTH command (RFC 4217). It returns false if the
+// TLS handshake failed and the session has to be closed.
+func (s *FTPServer) handleAuth(session *Session, param string) bool {
+	if s.tlsConfig == nil {
+		session.writeResponse(502, "TLS not configured on this server")
+		return true
+	}
+
+	mechanism := strings.ToUpper(param)
+	if mechanism != "TLS" && mechanism != "TLS-C" && mechanism != "SSL" {
+		session.writeResponse(504, "Security mechanism not understood")
+		return true
+	}
+	if session.tlsEnabled {
+		session.writeResponse(503, "TLS already active")
+		return true
+	}
+
+	session.writeResponse(234, "AUTH TLS successful")
+
+	// Upgrade the control connection
+	tlsConn := tls.Server(session.conn, s.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(s.dataTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		session.log().Warn("TLS handshake failed", "error", err)
+		return false
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	session.conn = tlsConn
+	session.controlReader = bufio.NewReader(tlsConn)
+	session.controlWriter = bufio.NewWriter(tlsConn)
+	session.tlsEnabled = true
+
+	// The login has to be repeated over the secure connection
+	if session.user != nil {
+		s.emit(session, Event{Type: EventLogout})
+	}
+	session.pendingUser = ""
+	session.user = nil
+	session.authenticated = false
+	return true
+}
+
+// handleProtectionBufferSize handles the PBSZ command. TLS doesn't use a
+// protection buffer, so the only valid size is 0.
+func (s *FTPServer) handleProtectionBufferSize(session *Session, param string) {
+	if !session.tlsEnabled {
+		session.writeResponse(503, "Use AUTH TLS first")
+		return
+	}
+
+	session.pbszSet = true
+	session.writeResponse(200, "PBSZ=0")
+}
+
+// handleProtectionLevel handles the PROT command
+func (s *FTPServer) handleProtectionLevel(session *Session, param string) {
+	if !session.pbszSet {
+		session.writeResponse(503, "Use PBSZ first")
+		return
+	}
+
+	switch strings.ToUpper(param) {
+	case "C":
+		session.protPrivate = false
+		session.writeResponse(200, "Protection level set to Clear")
+	case "P":
+		session.protPrivate = true
+		session.writeResponse(200, "Protection level set to Private")
+	case "S", "E":
+		session.writeResponse(536, "Protection level not supported")
+	default:
+		session.writeResponse(504, "Protection level not understood")
+	}
+}
+
+// openData waits for the session's data connection and, if PROT P is in
+// effect, performs the TLS handshake on it
+func (s *FTPServer) openData(session *Session) (net.Conn, error) {
+	conn, err := session.data.open()
+	if err != nil {
+		return nil, err
+	}
+	if !session.protPrivate {
+		return s.watchStall(conn), nil
+	}
+
+	tlsConn := tls.Server(conn, s.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(s.dataTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("data connection TLS handshake failed: %w", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	// Let the data channel close the TLS connection so the client gets a
+	// proper close_notify
+	session.data.upgrade(tlsConn)
+	return s.watchStall(tlsConn), nil
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// uploadTempPrefix starts the names of the hidden files uploads are written
+// to before they are renamed into place
+const uploadTempPrefix = ".ultraftp-upload-"
+
+// uploadTempPath returns a new temporary path for an upload to virtualPath.
+// It is in the same directory, so that renaming it into place is atomic on
+// file systems that support it. The name doesn't include that of the
+// target, so that it is short enough wherever the target's name is allowed.
+func uploadTempPath(virtualPath string) string {
+	var b [8]byte
+	rand.Read(b[:])
+	name := uploadTempPrefix + hex.EncodeToString(b[:])
+	return path.Join(path.Dir(virtualPath), name)
+}
+
+// isUploadTemp reports whether a file name is that of an upload in progress
+// or an abandoned one
+func isUploadTemp(name string) bool {
+	return strings.HasPrefix(name, uploadTempPrefix)
+}
+
+// allowName checks that a client may create a file or directory at
+// virtualPath, replying with an error if not. Names that would pass for
+// temporary upload files are reserved, as those are hidden and removed.
+func (s *Session) allowName(virtualPath string) bool {
+	if isUploadTemp(path.Base(virtualPath)) {
+		s.writeResponse(553, "File name not allowed")
+		return false
+	}
+	return true
+}
+
+// readDir returns the entries of a directory, leaving out the temporary
+// files of uploads
+func (s *Session) readDir(virtualPath string) ([]fs.FileInfo, error) {
+	entries, err := s.fs.ReadDir(virtualPath)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := entries[:0]
+	for _, entry := range entries {
+		if !isUploadTemp(entry.Name()) {
+			visible = append(visible, entry)
+		}
+	}
+	return visible, nil
+}
+
+// trackUpload remembers a temporary upload file so it can be removed if the
+// session ends before the upload is committed
+func (s *Session) trackUpload(tempPath string) {
+	if s.uploads == nil {
+		s.uploads = make(map[string]bool)
+	}
+	s.uploads[tempPath] = true
+}
+
+// commitUpload renames a finished upload into place
+func (s *Session) commitUpload(tempPath, virtualPath string) error {
+	if err := s.fs.Rename(tempPath, virtualPath); err != nil {
+		return err
+	}
+	delete(s.uploads, tempPath)
+	return nil
+}
+
+// discardUpload removes the temporary file of an upload that wasn't
+// committed, if there is one
+func (s *Session) discardUpload(tempPath string) {
+	if !s.uploads[tempPath] {
+		return
+	}
+	delete(s.uploads, tempPath)
+	if err := s.fs.Remove(tempPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		s.log().Warn("Error removing abandoned upload", "path", tempPath, "error", err)
+	}
+}
+
+// discardUploads removes the temporary files of all uncommitted uploads,
+// as done when the session ends
+func (s *Session) discardUploads() {
+	for tempPath := range s.uploads {
+		s.discardUpload(tempPath)
+	}
+}
+
+// removeStaleUploads deletes the temporary files of uploads abandoned by an
+// earlier run of the server. Files modified after before are left alone, as
+// they may belong to uploads that have started since. Read-only file
+// systems and those uploads don't use temporary files on aren't searched.
+// Absolute home directories are only searched if the authenticator lists
+// them.
+func (s *FTPServer) removeStaleUploads(before time.Time) {
+	if s.readOnly {
+		return
+	}
+
+	// Search each mount on its own, so that those that can be skipped are
+	filesystems := []FileSystem{s.fs}
+	if table, ok := s.fs.(*MountTable); ok {
+		filesystems = filesystems[:0]
+		for _, mount := range table.mounts {
+			filesystems = append(filesystems, mount.FileSystem)
+		}
+	}
+
+	// Users with an absolute home directory upload outside the server root
+	if lister, ok := s.auth.(HomeDirLister); ok {
+		seen := make(map[string]bool)
+		for _, dir := range lister.HomeDirs() {
+			if !filepath.IsAbs(dir) || seen[dir] {
+				continue
+			}
+			seen[dir] = true
+			fsys, err := NewOSFileSystem(dir)
+			if err != nil {
+				s.logger.Warn("Error looking for abandoned uploads", "path", dir, "error", err)
+				continue
+			}
+			filesystems = append(filesystems, fsys)
+		}
+	}
+
+	removed := 0
+	for _, fsys := range filesystems {
+		if _, ok := fsys.(readOnlyFileSystem); ok || createsAtomically(fsys, "/") {
+			continue
+		}
+		removed += s.removeStaleUploadsIn(fsys, before)
+	}
+
+	if removed > 0 {
+		s.logger.Info("Removed abandoned uploads", "count", removed)
+	}
+}
+
+// removeStaleUploadsIn deletes abandoned uploads from one file system and
+// returns how many it removed
+func (s *FTPServer) removeStaleUploadsIn(fsys FileSystem, before time.Time) int {
+	removed := 0
+	var walk func(dir string)
+	walk = func(dir string) {
+		entries, err := fsys.ReadDir(dir)
+		if err != nil {
+			s.logger.Warn("Error looking for abandoned uploads", "path", dir, "error", err)
+			return
+		}
+		for _, entry := range entries {
+			entryPath := path.Join(dir, entry.Name())
+			switch {
+			case entry.IsDir():
+				walk(entryPath)
+			case isUploadTemp(entry.Name()) && entry.ModTime().Before(before):
+				if err := fsys.Remove(entryPath); err != nil {
+					s.logger.Warn("Error removing abandoned upload", "path", entryPath, "error", err)
+					continue
+				}
+				removed++
+			}
+		}
+	}
+	walk("/")
+	return removed
+}
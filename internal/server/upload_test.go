@@ -0,0 +1,100 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRemoveStaleUploads(t *testing.T) {
+	root := NewMemFileSystem()
+	readOnly := NewMemFileSystem()
+	s3fs, fake := newTestS3FileSystem(t)
+
+	stale := uploadTempPrefix + "0123456789abcdef"
+	if err := root.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/" + stale, "/dir/" + stale, "/dir/file"} {
+		writeFile(t, root, name, []byte("data"))
+	}
+	writeFile(t, readOnly, "/"+stale, []byte("data"))
+	fake.putObject("root/"+stale, []byte("data"))
+
+	srv, err := New(Options{
+		FileSystem: root,
+		Mounts: []Mount{
+			{Path: "/ro", FileSystem: ReadOnly(readOnly)},
+			{Path: "/s3", FileSystem: s3fs},
+		},
+		AllowAnonymous: true,
+		Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploads that may have started since are kept
+	srv.removeStaleUploads(time.Now().Add(-time.Hour))
+	if got := dirNames(t, root, "/dir"); !equalStrings(got, []string{stale, "file"}) {
+		t.Errorf("recent upload removed, /dir contains %q", got)
+	}
+
+	srv.removeStaleUploads(time.Now().Add(time.Hour))
+	if got := dirNames(t, root, "/"); !equalStrings(got, []string{"dir/"}) {
+		t.Errorf("/ contains %q", got)
+	}
+	if got := dirNames(t, root, "/dir"); !equalStrings(got, []string{"file"}) {
+		t.Errorf("/dir contains %q", got)
+	}
+
+	if got := dirNames(t, readOnly, "/"); !equalStrings(got, []string{stale}) {
+		t.Errorf("read-only mount changed, contains %q", got)
+	}
+	if fake.count("ListObjectsV2") != 0 || fake.count("DeleteObject") != 0 {
+		t.Error("S3 mount searched for uploads")
+	}
+}
+
+// TestRemoveStaleUploadsHomeDirs checks that abandoned uploads are removed
+// from home directories outside the server root
+func TestRemoveStaleUploadsHomeDirs(t *testing.T) {
+	home := t.TempDir()
+	stale := filepath.Join(home, uploadTempPrefix+"0123456789abcdef")
+	if err := os.WriteFile(stale, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersFile := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(usersFile, []byte("alice:"+string(hash)+" home="+home+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewFileAuthenticator(usersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := New(Options{
+		FileSystem:     NewMemFileSystem(),
+		Authenticator:  auth,
+		AllowAnonymous: true,
+		Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.removeStaleUploads(time.Now().Add(time.Hour))
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("abandoned upload in home directory not removed: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// xferlogTimeFormat is the ctime-style timestamp that starts an xferlog line
+const xferlogTimeFormat = "Mon Jan _2 15:04:05 2006"
+
+// Transfer directions as recorded in the xferlog
+const (
+	xferOutgoing = "o"
+	xferIncoming = "i"
+)
+
+// transferLog writes one line per file transfer in the xferlog format used
+// by wu-ftpd and vsftpd
+type transferLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// transferRecord describes a finished or aborted transfer
+type transferRecord struct {
+	start     time.Time
+	remote    string
+	bytes     int64
+	path      string
+	direction string
+	user      *User
+	completed bool
+}
+
+// write appends a record to the log
+func (l *transferLog) write(r transferRecord) error {
+	// Durations are whole seconds, rounded, and never reported as zero
+	seconds := int64(math.Round(time.Since(r.start).Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	// Fields are space separated, so spaces in names can't be kept
+	path := strings.ReplaceAll(r.path, " ", "_")
+
+	accessMode, username := "r", "*"
+	if r.user != nil {
+		username = strings.ReplaceAll(r.user.Name, " ", "_")
+		if r.user.Anonymous {
+			accessMode = "a"
+		}
+	}
+
+	status := "i"
+	if r.completed {
+		status = "c"
+	}
+
+	// Files are always sent unmodified, so the type is always binary and
+	// there's no special action
+	line := fmt.Sprintf("%s %d %s %d %s b _ %s %s %s ftp 0 * %s\n",
+		time.Now().Format(xferlogTimeFormat), seconds, r.remote, r.bytes,
+		path, r.direction, accessMode, username, status)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := io.WriteString(l.w, line)
+	return err
+}
+
+// recordTransfer counts a transfer in the metrics and writes it to the
+// transfer log, if one is configured
+func (s *FTPServer) recordTransfer(session *Session, start time.Time, virtualPath, direction string, bytes int64, completed bool) {
+	metricDirection := "sent"
+	if direction == xferIncoming {
+		metricDirection = "received"
+	}
+	s.metrics.countTransfer(metricDirection, bytes, time.Since(start), completed)
+
+	if s.xferlog == nil {
+		return
+	}
+
+	err := s.xferlog.write(transferRecord{
+		start:     start,
+		remote:    addrIP(session.netConn.RemoteAddr()).String(),
+		bytes:     bytes,
+		path:      virtualPath,
+		direction: direction,
+		user:      session.user,
+		completed: completed,
+	})
+	if err != nil {
+		session.log().Error("Error writing transfer log", "error", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 // Config represents the application configuration
@@ -13,6 +14,15 @@ type Config struct {
 	ServerPort int
 	ServerDir  string
 
+	// PassivePortMin and PassivePortMax limit the ports used for passive
+	// data connections. Zero means any free port.
+	PassivePortMin int
+	PassivePortMax int
+
+	// PublicHost is the IP address or hostname advertised in passive mode
+	// replies instead of the control connection's local address
+	PublicHost string
+
 	// Client configuration
 	DefaultUser     string
 	DefaultPassword string
@@ -43,6 +53,17 @@ func LoadConfig() *Config {
 		config.ServerDir = dir
 	}
 
+	if ports := os.Getenv("ULTRAFTP_PASSIVE_PORTS"); ports != "" {
+		if min, max, err := ParsePortRange(ports); err == nil {
+			config.PassivePortMin = min
+			config.PassivePortMax = max
+		}
+	}
+
+	if host := os.Getenv("ULTRAFTP_PUBLIC_HOST"); host != "" {
+		config.PublicHost = host
+	}
+
 	// Load client configuration
 	if user := os.Getenv("ULTRAFTP_DEFAULT_USER"); user != "" {
 		config.DefaultUser = user
@@ -77,5 +98,35 @@ func (c *Config) ValidateServerConfig() error {
 		return fmt.Errorf("not a directory: %s", absDir)
 	}
 
+	// Validate passive port range
+	if c.PassivePortMin != 0 || c.PassivePortMax != 0 {
+		if c.PassivePortMin <= 0 || c.PassivePortMax > 65535 || c.PassivePortMin > c.PassivePortMax {
+			return fmt.Errorf("invalid passive port range: %d-%d", c.PassivePortMin, c.PassivePortMax)
+		}
+	}
+
 	return nil
 }
+
+// ParsePortRange parses a port range of the form "min-max"
+func ParsePortRange(s string) (min, max int, err error) {
+	minStr, maxStr, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid port range %q, expected min-max", s)
+	}
+
+	min, err = strconv.Atoi(strings.TrimSpace(minStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	max, err = strconv.Atoi(strings.TrimSpace(maxStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+
+	if min <= 0 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+
+	return min, max, nil
+}
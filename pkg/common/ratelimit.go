@@ -0,0 +1,188 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting throughput to a number of bytes per
+// second. It may be shared by several transfers, which then split the rate
+// between them. A nil RateLimiter doesn't limit anything.
+type RateLimiter struct {
+	rate   float64 // bytes per second
+	burst  float64
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter for the given number of bytes per
+// second, or nil if bytesPerSecond isn't positive
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	rate := float64(bytesPerSecond)
+	return &RateLimiter{
+		rate:   rate,
+		burst:  rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until n bytes may be transferred
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	// Take the tokens now, going into debt if there aren't enough, and
+	// sleep until the debt is paid off
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// chunkSize returns how many bytes to transfer between waits so that no
+// single wait on the given limiters takes much longer than a tenth of a
+// second
+func chunkSize(limiters []*RateLimiter) int {
+	size := 32 * 1024
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		if n := int(l.rate / 10); n < size {
+			size = n
+		}
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// activeLimiters returns the non-nil limiters
+func activeLimiters(limiters []*RateLimiter) []*RateLimiter {
+	var active []*RateLimiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	return active
+}
+
+// limitedReader throttles reads with a set of limiters
+type limitedReader struct {
+	r        io.Reader
+	limiters []*RateLimiter
+	chunk    int
+}
+
+// NewLimitedReader returns a reader that reads from r no faster than every
+// one of the limiters allows. If no limiter is set, r is returned as is.
+func NewLimitedReader(r io.Reader, limiters ...*RateLimiter) io.Reader {
+	active := activeLimiters(limiters)
+	if len(active) == 0 {
+		return r
+	}
+	return &limitedReader{r: r, limiters: active, chunk: chunkSize(active)}
+}
+
+// Read implements io.Reader
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	n, err := r.r.Read(p)
+	for _, l := range r.limiters {
+		l.Wait(n)
+	}
+	return n, err
+}
+
+// limitedWriter throttles writes with a set of limiters
+type limitedWriter struct {
+	w        io.Writer
+	limiters []*RateLimiter
+	chunk    int
+}
+
+// NewLimitedWriter returns a writer that writes to w no faster than every
+// one of the limiters allows. If no limiter is set, w is returned as is.
+func NewLimitedWriter(w io.Writer, limiters ...*RateLimiter) io.Writer {
+	active := activeLimiters(limiters)
+	if len(active) == 0 {
+		return w
+	}
+	return &limitedWriter{w: w, limiters: active, chunk: chunkSize(active)}
+}
+
+// Write implements io.Writer
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > w.chunk {
+			chunk = chunk[:w.chunk]
+		}
+		for _, l := range w.limiters {
+			l.Wait(len(chunk))
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// ParseRate parses a transfer rate in bytes per second, such as "500k",
+// "1.5M" or "2G". Suffixes are binary multiples and may be followed by "B"
+// or "/s"; a plain number is bytes. "0" means unlimited.
+func ParseRate(s string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	value = strings.TrimSuffix(value, "/s")
+	value = strings.TrimSuffix(value, "b")
+
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "m"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "g"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 || math.IsInf(number, 0) || math.IsNaN(number) {
+		return 0, fmt.Errorf("invalid rate %q, expected a number of bytes per second such as 500k or 2M", s)
+	}
+	return int64(number * multiplier), nil
+}